@@ -0,0 +1,202 @@
+package main
+
+import (
+	"golang.org/x/net/ipv4"
+	"layeh.com/radius"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	buffers *sync.Pool = &sync.Pool{New: func() interface{} {
+		return new([radius.MaxPacketLength]byte)
+	}}
+	// packets per read/write syscall (recvmmsg/sendmmsg), 0 disables batching
+	batchSize int
+	// replies waiting for the batched writer (nil when not batching)
+	replies chan *outgoing
+	// closed to stop the batched writer, which closes writerDone once it has written what was queued
+	writerStop chan bool
+	writerDone chan bool
+	// set when reading stops (on shutdown), the sockets stay open for replies
+	readStopped int32
+)
+
+type outgoing struct {
+	socket *net.UDPConn
+	buffer *[radius.MaxPacketLength]byte
+	n      int
+	addr   *net.UDPAddr
+}
+
+func getBuffer() *[radius.MaxPacketLength]byte {
+	return buffers.Get().(*[radius.MaxPacketLength]byte)
+}
+
+func putBuffer(b *[radius.MaxPacketLength]byte) {
+	buffers.Put(b)
+}
+
+// stop reading from sockets (waking any blocked reads) without closing them
+func stopReading(sockets []*net.UDPConn) {
+	atomic.StoreInt32(&readStopped, 1)
+	for _, socket := range sockets {
+		socket.SetReadDeadline(time.Now())
+	}
+}
+
+// a read ended by stopReading
+func readingStopped(err error) bool {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return atomic.LoadInt32(&readStopped) == 1
+	}
+	return false
+}
+
+// read packets until the socket is closed (or reading stopped), the handler owns (and must put back) each buffer
+func readPackets(conn *net.UDPConn, handle func(b *[radius.MaxPacketLength]byte, n int, addr *net.UDPAddr)) error {
+	if batchSize > 0 {
+		return readBatches(conn, batchSize, handle)
+	}
+	for {
+		b := getBuffer()
+		n, addr, err := conn.ReadFromUDP(b[0:])
+		if err != nil {
+			putBuffer(b)
+			if isClosed(err) || readingStopped(err) {
+				return err
+			}
+			logError("read from udp", err)
+			continue
+		}
+		handle(b, n, addr)
+	}
+}
+
+func readBatches(conn *net.UDPConn, size int, handle func(b *[radius.MaxPacketLength]byte, n int, addr *net.UDPAddr)) error {
+	pc := ipv4.NewPacketConn(conn)
+	msgs := make([]ipv4.Message, size)
+	bufs := make([]*[radius.MaxPacketLength]byte, size)
+	for {
+		for i := range msgs {
+			if bufs[i] == nil {
+				bufs[i] = getBuffer()
+			}
+			msgs[i].Buffers = [][]byte{bufs[i][0:]}
+		}
+		count, err := pc.ReadBatch(msgs, 0)
+		if err != nil {
+			if isClosed(err) || readingStopped(err) {
+				for _, b := range bufs {
+					putBuffer(b)
+				}
+				return err
+			}
+			logError("batch read from udp", err)
+			continue
+		}
+		for i := 0; i < count; i++ {
+			addr, ok := msgs[i].Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			handle(bufs[i], msgs[i].N, addr)
+			bufs[i] = nil
+		}
+	}
+}
+
+// start the batched writer (replies are queued from then on)
+func startWriter(size, depth int) {
+	replies = make(chan *outgoing, size*depth)
+	writerStop = make(chan bool)
+	writerDone = make(chan bool)
+	go writeBatches(size, replies, writerStop, writerDone)
+}
+
+// stop the batched writer and wait for it to exit
+func stopWriter() {
+	if writerStop == nil {
+		return
+	}
+	close(writerStop)
+	<-writerDone
+}
+
+// queue a reply for the batched writer, dropped once it stopped
+func queueReply(socket *net.UDPConn, b []byte, addr *net.UDPAddr) {
+	buffer := getBuffer()
+	n := copy(buffer[0:], b)
+	select {
+	case replies <- &outgoing{socket: socket, buffer: buffer, n: n, addr: addr}:
+	case <-writerStop:
+		putBuffer(buffer)
+	}
+}
+
+// the next queued reply, false once stopped with nothing queued
+func nextReply(queue chan *outgoing, stop chan bool) (*outgoing, bool) {
+	select {
+	case o := <-queue:
+		return o, true
+	case <-stop:
+		select {
+		case o := <-queue:
+			return o, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+// write queued replies, as many as are waiting (up to the batch size) per syscall and socket
+func writeBatches(size int, queue chan *outgoing, stop, done chan bool) {
+	defer close(done)
+	conns := make(map[*net.UDPConn]*ipv4.PacketConn)
+	msgs := make([]ipv4.Message, 0, size)
+	pending := make([]*outgoing, 0, size)
+	for {
+		first, ok := nextReply(queue, stop)
+		if !ok {
+			return
+		}
+		pending = append(pending[:0], first)
+	fill:
+		for len(pending) < size {
+			select {
+			case o := <-queue:
+				pending = append(pending, o)
+			default:
+				break fill
+			}
+		}
+		for start := 0; start < len(pending); {
+			// consecutive replies from the same socket
+			socket := pending[start].socket
+			msgs = msgs[:0]
+			for start < len(pending) && pending[start].socket == socket {
+				o := pending[start]
+				msgs = append(msgs, ipv4.Message{Buffers: [][]byte{o.buffer[0:o.n]}, Addr: o.addr})
+				start++
+			}
+			pc, ok := conns[socket]
+			if !ok {
+				pc = ipv4.NewPacketConn(socket)
+				conns[socket] = pc
+			}
+			for len(msgs) > 0 {
+				n, err := pc.WriteBatch(msgs, 0)
+				if err != nil {
+					logError("batch write to udp", err)
+					break
+				}
+				msgs = msgs[n:]
+			}
+		}
+		for _, o := range pending {
+			putBuffer(o.buffer)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"github.com/epiphyte/radiucal/plugins"
+	"layeh.com/radius"
+	"net"
+	"testing"
+	"time"
+)
+
+func newUDPPair(t testing.TB) (*net.UDPConn, *net.UDPConn) {
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	srv, err := net.ListenUDP("udp", local)
+	if err != nil {
+		t.Fatal("unable to listen", err)
+	}
+	cli, err := net.DialUDP("udp", nil, srv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal("unable to dial", err)
+	}
+	return srv, cli
+}
+
+func readCount(t *testing.T, size int) {
+	batchSize = size
+	defer func() { batchSize = 0 }()
+	srv, cli := newUDPPair(t)
+	defer cli.Close()
+	_, b := getPacket(t)
+	received := make(chan int, 10)
+	go func() {
+		readPackets(srv, func(buffer *[radius.MaxPacketLength]byte, n int, addr *net.UDPAddr) {
+			if addr.String() != cli.LocalAddr().String() || string(buffer[0:n]) != string(b) {
+				t.Error("invalid packet")
+			}
+			putBuffer(buffer)
+			received <- n
+		})
+		close(received)
+	}()
+	for i := 0; i < 5; i++ {
+		cli.Write(b)
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Error("packet not read")
+		}
+	}
+	srv.Close()
+	if _, ok := <-received; ok {
+		t.Error("should stop reading when closed")
+	}
+}
+
+func TestReadPackets(t *testing.T) {
+	readCount(t, 0)
+}
+
+func TestReadBatches(t *testing.T) {
+	readCount(t, 4)
+}
+
+func TestWriteBatches(t *testing.T) {
+	srv, cli := newUDPPair(t)
+	defer srv.Close()
+	defer cli.Close()
+	startWriter(4, 3)
+	addr := cli.LocalAddr().(*net.UDPAddr)
+	send := udpSender(srv, addr)
+	send([]byte("first"))
+	send([]byte("second"))
+	var buffer [radius.MaxPacketLength]byte
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expect := range []string{"first", "second"} {
+		n, err := cli.Read(buffer[0:])
+		if err != nil || string(buffer[0:n]) != expect {
+			t.Error("invalid reply", err)
+		}
+	}
+	stopWriter()
+	if err := send([]byte("dropped")); err != nil {
+		t.Error("should drop replies once stopped", err)
+	}
+	replies = nil
+	writerStop = nil
+	writerDone = nil
+}
+
+func benchmarkRead(b *testing.B, size int) {
+	batchSize = size
+	defer func() { batchSize = 0 }()
+	srv, cli := newUDPPair(b)
+	defer cli.Close()
+	packet := make([]byte, 200)
+	packet[0] = byte(radius.CodeAccessRequest)
+	received := make(chan bool, 32)
+	go readPackets(srv, func(buffer *[radius.MaxPacketLength]byte, n int, addr *net.UDPAddr) {
+		putBuffer(buffer)
+		received <- true
+	})
+	b.ResetTimer()
+	// bursts (as from many NAS) small enough to not be dropped
+	for i := 0; i < b.N; i += 32 {
+		burst := 32
+		if b.N-i < burst {
+			burst = b.N - i
+		}
+		for j := 0; j < burst; j++ {
+			cli.Write(packet)
+		}
+		for j := 0; j < burst; j++ {
+			select {
+			case <-received:
+			case <-time.After(time.Second):
+				b.Fatal("packets were lost")
+			}
+		}
+	}
+	b.StopTimer()
+	srv.Close()
+}
+
+func BenchmarkReadSingle(b *testing.B) {
+	benchmarkRead(b, 0)
+}
+
+func BenchmarkReadBatch(b *testing.B) {
+	benchmarkRead(b, 32)
+}
+
+var sink *[radius.MaxPacketLength]byte
+
+func BenchmarkBufferAlloc(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sink = new([radius.MaxPacketLength]byte)
+	}
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		sink = getBuffer()
+		putBuffer(sink)
+	}
+}
+
+func benchmarkModules(b *testing.B, parse func(*context, []byte, *client)) {
+	ctx, packet := getPacket(&testing.T{})
+	for i := 0; i < 4; i++ {
+		m := &MockModule{}
+		ctx.preauths = append(ctx.preauths, plugins.AsDeciding(m))
+		ctx.auths = append(ctx.auths, m)
+	}
+	ctx.preauth = true
+	ctx.auth = true
+	nas := localNAS(ctx)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parse(ctx, packet, nas)
+	}
+}
+
+// a parse per mode (as before) vs a single shared parse
+func BenchmarkParsePerMode(b *testing.B) {
+	benchmarkModules(b, func(ctx *context, packet []byte, nas *client) {
+		p, _ := ctx.packet(packet, nas)
+		ctx.decide(p)
+		ctx.packet(packet, nas)
+		ctx.packet(packet, nas)
+	})
+}
+
+func BenchmarkParseShared(b *testing.B) {
+	benchmarkModules(b, func(ctx *context, packet []byte, nas *client) {
+		p, _ := ctx.packet(packet, nas)
+		ctx.decide(p)
+	})
+}
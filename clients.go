@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"net"
+	"os"
+	"strings"
+)
+
+// a NAS (by address or network) and the secret it uses
+type client struct {
+	network *net.IPNet
+	secret  []byte
+	name    string
+}
+
+type clientTable struct {
+	entries []*client
+}
+
+func (c *client) String() string {
+	if len(c.name) > 0 {
+		return c.name
+	}
+	return c.network.String()
+}
+
+// parse an address or cidr into a network
+func parseNetwork(addr string) (*net.IPNet, error) {
+	if strings.Contains(addr, "/") {
+		_, network, err := net.ParseCIDR(addr)
+		return network, err
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, errors.New(fmt.Sprintf("invalid address: %s", addr))
+	}
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	} else {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// find the most specific entry for an address, nil when unknown
+func (t *clientTable) lookup(ip net.IP) *client {
+	if t == nil {
+		return nil
+	}
+	var match *client
+	matched := -1
+	for _, c := range t.entries {
+		if !c.network.Contains(ip) {
+			continue
+		}
+		size, _ := c.network.Mask.Size()
+		if size > matched {
+			match = c
+			matched = size
+		}
+	}
+	return match
+}
+
+// same entries (in order) as another table
+func (t *clientTable) equal(other *clientTable) bool {
+	if t == nil || other == nil {
+		return t == other
+	}
+	if len(t.entries) != len(other.entries) {
+		return false
+	}
+	for i, c := range t.entries {
+		o := other.entries[i]
+		if c.network.String() != o.network.String() || !bytes.Equal(c.secret, o.secret) || c.name != o.name {
+			return false
+		}
+	}
+	return true
+}
+
+// parse a radius_clients style file: <ip|cidr> <secret> [shortname]
+func parseClientFile(clientFile string) (*clientTable, error) {
+	if goutils.PathNotExists(clientFile) {
+		return nil, errors.New("no clients file")
+	}
+	f, err := os.Open(clientFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	table := &clientTable{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		l := strings.TrimSpace(scanner.Text())
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.Fields(l)
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, errors.New(fmt.Sprintf("invalid client entry on line %d", line))
+		}
+		network, err := parseNetwork(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		c := &client{network: network, secret: []byte(parts[1])}
+		if len(parts) == 3 {
+			c.name = parts[2]
+		}
+		table.entries = append(table.entries, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(table.entries) == 0 {
+		return nil, errors.New("no clients found")
+	}
+	return table, nil
+}
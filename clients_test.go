@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func checkClient(t *testing.T, table *clientTable, ip, secret, name string) {
+	c := table.lookup(net.ParseIP(ip))
+	if c == nil {
+		if secret != "" {
+			t.Errorf("%s should be a known client", ip)
+		}
+		return
+	}
+	if string(c.secret) != secret {
+		t.Errorf("%s has the wrong secret: %s", ip, string(c.secret))
+	}
+	if c.String() != name {
+		t.Errorf("%s has the wrong name: %s", ip, c.String())
+	}
+}
+
+func TestClientParsing(t *testing.T) {
+	dir := "./tests/"
+	_, err := parseClientFile(dir + "nofile")
+	if err.Error() != "no clients file" {
+		t.Error("file does not exist")
+	}
+	_, err = parseClientFile(dir + "emptysecrets")
+	if err.Error() != "no clients found" {
+		t.Error("file is empty")
+	}
+	_, err = parseClientFile(dir + "noopsecret")
+	if err.Error() != "invalid client entry on line 1" {
+		t.Error("entry has no secret")
+	}
+	table, err := parseClientFile(dir + "multisecret")
+	if err != nil {
+		t.Error("should have parsed")
+	}
+	checkClient(t, table, "192.168.1.1", "a", "192.168.1.1/32")
+	checkClient(t, table, "10.10.10.10", "xyz", "10.10.10.10/32")
+	checkClient(t, table, "10.10.10.11", "", "")
+	table, _ = parseClientFile(dir + "clients")
+	checkClient(t, table, "127.0.0.1", "test", "127.0.0.1/32")
+	checkClient(t, table, "10.10.10.10", "switch", "switch1")
+	checkClient(t, table, "10.10.1.1", "network", "10.10.0.0/16")
+	checkClient(t, table, "::1", "ipv6", "::1/128")
+	checkClient(t, table, "10.11.1.1", "", "")
+	var empty *clientTable
+	if empty.lookup(net.ParseIP("127.0.0.1")) != nil {
+		t.Error("no table, no clients")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"github.com/epiphyte/radiucal/plugins"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	active     *context      = &context{}
+	activeLock *sync.RWMutex = new(sync.RWMutex)
+	// plugins by name, a loaded plugin can not be unloaded (only no longer used) and keeps
+	// the configuration it was set up with (settings of loaded plugins require a restart)
+	loaded map[string]plugins.Module = make(map[string]plugins.Module)
+	// settings that are only read on startup
+	restartKeys = []string{
+		"accounting",
+		"acct_bind",
+		"bind",
+		"coa_port",
+		"coa_retries",
+		"coa_timeout",
+		"control",
+		"drain_timeout",
+		"duplicate_window",
+		"health_failures",
+		"health_interval",
+		"idle_timeout",
+		"mac_burst",
+		"mac_rate",
+		"max_clients",
+		"max_streams",
+		"nas_burst",
+		"nas_rate",
+		"queue_depth",
+		"radsec",
+		"radsec_bind",
+		"radsec_ca",
+		"radsec_cert",
+		"radsec_key",
+		"radsec_key_password",
+		"rate_action",
+		"session_timeout",
+		"tcp",
+		"tcp_bind",
+		"udp_batch",
+		"workers",
+	}
+)
+
+// the running context, requests are handled with the context current when they arrive
+func currentContext() *context {
+	activeLock.RLock()
+	defer activeLock.RUnlock()
+	return active
+}
+
+func setContext(ctx *context) {
+	activeLock.Lock()
+	defer activeLock.Unlock()
+	active = ctx
+}
+
+func configureLogging(debug bool, instance string) {
+	logOpts := goutils.NewLogOptions()
+	logOpts.Debug = debug
+	logOpts.Info = true
+	logOpts.Instance = instance
+	goutils.ConfigureLogging(logOpts)
+}
+
+// build a context (and the upstream pools) from the configuration
+func loadContext(conf *goutils.Config, instance string, debugging, accounting bool) (*context, map[string]*pool, error) {
+	ctx := &context{conf: conf}
+	ctx.debug = conf.GetTrue("debug") || debugging
+	ctx.noreject = conf.GetTrue("noreject")
+	ctx.ackSuccess = conf.GetTrue("ack_on_success")
+	ctx.rejectReason = conf.GetTrue("reject_reason")
+	lib := conf.GetStringOrDefault("dir", "/var/lib/radiucal/")
+	secrets := filepath.Join(lib, "secrets")
+	clients, err := parseClientFile(secrets)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx.clients = clients
+	// the legacy "127.0.0.1 <secret>" line (optional) is the default upstream secret
+	if secret, err := parseSecretFile(secrets); err == nil {
+		ctx.secret = []byte(secret)
+	}
+	// separate secrets for upstreams (if any) to translate to/from, otherwise
+	// the entry of the upstream in the clients table (or the default secret)
+	upstreamSecrets := ctx.clients
+	fallback := ctx.secret
+	upstreamFile := filepath.Join(lib, "upstream_secrets")
+	if goutils.PathExists(upstreamFile) {
+		upstreamSecrets, err = parseClientFile(upstreamFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		fallback = nil
+	}
+	servers := make(map[string]*pool)
+	acctBind, err := conf.GetIntOrDefault("acct_bind", 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if accounting || acctBind > 0 {
+		if hosts := conf.GetArrayOrEmpty("acct_upstream"); len(hosts) > 0 {
+			p, err := newPool(accountingPool, hosts, upstreamSecrets, fallback)
+			if err != nil {
+				return nil, nil, err
+			}
+			servers[accountingPool] = p
+		}
+	}
+	if !accounting {
+		hosts := conf.GetArrayOrEmpty("upstream")
+		if len(hosts) == 0 {
+			to, err := conf.GetIntOrDefault("to", 1814)
+			if err != nil {
+				return nil, nil, err
+			}
+			hosts = append(hosts, fmt.Sprintf("%s:%d", conf.GetStringOrDefault("host", "localhost"), to))
+		}
+		p, err := newPool(defaultPool, hosts, upstreamSecrets, fallback)
+		if err != nil {
+			return nil, nil, err
+		}
+		servers[defaultPool] = p
+		// named pools for routing
+		for _, name := range conf.GetArrayOrEmpty("pools") {
+			if _, ok := servers[name]; ok || name == accountingPool {
+				return nil, nil, errors.New(fmt.Sprintf("pool name in use: %s", name))
+			}
+			p, err := newPool(name, conf.GetArrayOrEmpty(fmt.Sprintf("pool_%s", name)), upstreamSecrets, fallback)
+			if err != nil {
+				return nil, nil, err
+			}
+			servers[name] = p
+		}
+		ctx.routes, err = parseRoutes(conf.GetArrayOrEmpty("route"), conf.GetArrayOrEmpty("route_realm"), conf.GetStringOrDefault("route_default", defaultPool), servers)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	pCtx := &plugins.PluginContext{}
+	pCtx.Logs = filepath.Join(lib, "log")
+	pCtx.Lib = lib
+	pCtx.Config = conf
+	pCtx.Instance = instance
+	pCtx.DynAuth = &dynamicAuth{}
+	pCtx.Sessions = &sessionTable{}
+	// new plugins are loaded first so a failure leaves the running plugins untouched,
+	// plugins already loaded keep their state (they are set up once and only reloaded)
+	mods := conf.GetArrayOrEmpty("plugins")
+	pPath := filepath.Join(lib, "plugins")
+	for _, p := range mods {
+		if _, ok := loaded[p]; ok {
+			continue
+		}
+		oPath := filepath.Join(pPath, fmt.Sprintf("%s.rd", p))
+		goutils.WriteInfo("loading plugin", p, oPath)
+		obj, err := plugins.LoadPlugin(oPath, pCtx)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("unable to load plugin: %s (%s)", p, err))
+		}
+		loaded[p] = obj
+	}
+	for _, p := range mods {
+		ctx.use(p, loaded[p])
+	}
+	return ctx, servers, nil
+}
+
+// describe what differs in the next context
+func (ctx *context) changes(next *context) []string {
+	var changed []string
+	toggled := func(name string, from, to bool) {
+		if from != to {
+			changed = append(changed, fmt.Sprintf("%s: %t -> %t", name, from, to))
+		}
+	}
+	toggled("debug", ctx.debug, next.debug)
+	toggled("noreject", ctx.noreject, next.noreject)
+	toggled("ack_on_success", ctx.ackSuccess, next.ackSuccess)
+	toggled("reject_reason", ctx.rejectReason, next.rejectReason)
+	if !bytes.Equal(ctx.secret, next.secret) {
+		changed = append(changed, "secret changed")
+	}
+	if !ctx.clients.equal(next.clients) {
+		changed = append(changed, "clients changed")
+	}
+	if ctx.routes.String() != next.routes.String() {
+		changed = append(changed, fmt.Sprintf("routes: [%s] -> [%s]", ctx.routes.String(), next.routes.String()))
+	}
+	for _, name := range next.names {
+		if !contains(ctx.names, name) {
+			changed = append(changed, fmt.Sprintf("plugin enabled: %s", name))
+		}
+	}
+	for _, name := range ctx.names {
+		if !contains(next.names, name) {
+			changed = append(changed, fmt.Sprintf("plugin disabled: %s", name))
+		}
+	}
+	return changed
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// re-read the configuration (and secrets), the running context is only replaced when it all loads
+func reload(file, instance string, debugging, accounting bool) {
+	goutils.WriteInfo("reloading", file)
+	conf, err := goutils.LoadConfig(file, goutils.NewConfigSettings())
+	if err != nil {
+		goutils.WriteError("reload refused, unable to load config", err)
+		return
+	}
+	next, servers, err := loadContext(conf, instance, debugging, accounting)
+	if err != nil {
+		goutils.WriteError("reload refused", err)
+		return
+	}
+	ctx := currentContext()
+	if ctx.conf != nil {
+		for _, k := range restartKeys {
+			if strings.Join(ctx.conf.GetArrayOrEmpty(k), ",") != strings.Join(conf.GetArrayOrEmpty(k), ",") {
+				goutils.WriteInfo("change requires a restart (ignored)", k)
+			}
+		}
+	}
+	changed := append(ctx.changes(next), poolChanges(servers)...)
+	if len(changed) == 0 {
+		goutils.WriteInfo("no configuration changes")
+	}
+	for _, c := range changed {
+		goutils.WriteInfo("reload", c)
+	}
+	configureLogging(next.debug, instance)
+	setPools(servers)
+	setContext(next)
+	dropChangedClients(next.clients)
+	next.reload()
+}
+
+// drop (udp) clients whose secret changed (the NAS will start over with the new secret) or that were removed
+func dropChangedClients(table *clientTable) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	for k, c := range clients {
+		addr, ok := c.client.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		nas := table.lookup(addr.IP)
+		if nas == nil || !bytes.Equal(nas.secret, c.nas.secret) {
+			c.close()
+			delete(clients, k)
+		}
+	}
+}
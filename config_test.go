@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(dir, secrets, config string) string {
+	ioutil.WriteFile(filepath.Join(dir, "secrets"), []byte(secrets), 0600)
+	file := filepath.Join(dir, "radiucal.conf")
+	ioutil.WriteFile(file, []byte(fmt.Sprintf("dir=%s\n%s", dir, config)), 0600)
+	return file
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reload")
+	defer os.RemoveAll(dir)
+	closeClients()
+	file := writeConfig(dir, "127.0.0.1 secret\n", "upstream=127.0.0.1:1814\n")
+	setContext(&context{})
+	setPools(make(map[string]*pool))
+	reload(file, "", false, false)
+	ctx := currentContext()
+	if ctx.conf == nil || string(ctx.secret) != "secret" || ctx.noreject {
+		t.Error("should have loaded config")
+	}
+	first := getPool(defaultPool)
+	if first == nil || first.String() != "127.0.0.1:1814" {
+		t.Error("should have loaded upstreams")
+	}
+	cli := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10000}
+	conn := getConnection(cli, ctx.clients.lookup(cli.IP))
+
+	// refused, the running context is kept
+	writeConfig(dir, "", "noreject=true\n")
+	reload(file, "", false, false)
+	if currentContext() != ctx {
+		t.Error("should have refused reload")
+	}
+
+	// unchanged secret and upstream are kept
+	writeConfig(dir, "127.0.0.1 secret\n", "noreject=true\nupstream=127.0.0.1:1814\nupstream=127.0.0.1:1815\n")
+	reload(file, "", false, false)
+	next := currentContext()
+	if next == ctx || !next.noreject {
+		t.Error("should have reloaded")
+	}
+	if changes := ctx.changes(next); len(changes) != 1 || changes[0] != "noreject: false -> true" {
+		t.Error("invalid changes", changes)
+	}
+	servers := getPool(defaultPool)
+	if len(servers.servers) != 2 || servers.servers[0] != first.servers[0] {
+		t.Error("should have kept the unchanged upstream")
+	}
+	if conn.closed() {
+		t.Error("should have kept the client")
+	}
+
+	// secret change drops the client
+	writeConfig(dir, "127.0.0.1 changed\n", "upstream=127.0.0.1:1814\n")
+	reload(file, "", false, false)
+	changes := next.changes(currentContext())
+	if len(changes) != 3 || changes[1] != "secret changed" || changes[2] != "clients changed" {
+		t.Error("invalid changes", changes)
+	}
+	if !conn.closed() || len(clients) != 0 {
+		t.Error("should have dropped the client")
+	}
+
+	// removing the client drops it
+	conn = getConnection(cli, currentContext().clients.lookup(cli.IP))
+	writeConfig(dir, "10.0.0.1 other\n", "upstream=10.0.0.1:1814\n")
+	reload(file, "", false, false)
+	if currentContext().clients.lookup(cli.IP) != nil {
+		t.Error("should have removed the client")
+	}
+	if !conn.closed() || len(clients) != 0 {
+		t.Error("should have dropped the removed client")
+	}
+	setPools(make(map[string]*pool))
+	setContext(&context{})
+}
+
+func TestPoolChanges(t *testing.T) {
+	setPools(make(map[string]*pool))
+	next, _ := newPool(defaultPool, []string{"127.0.0.1:1814"}, nil, []byte("secret"))
+	changes := poolChanges(map[string]*pool{defaultPool: next})
+	if len(changes) != 1 || changes[0] != "upstream default: [] -> [127.0.0.1:1814]" {
+		t.Error("invalid changes", changes)
+	}
+	setPools(map[string]*pool{defaultPool: next})
+	if len(poolChanges(map[string]*pool{defaultPool: next})) != 0 {
+		t.Error("no changes")
+	}
+	changes = poolChanges(make(map[string]*pool))
+	if len(changes) != 1 || changes[0] != "upstream default: [127.0.0.1:1814] -> []" {
+		t.Error("invalid changes", changes)
+	}
+	setPools(make(map[string]*pool))
+}
+
+func TestNamedPools(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pools")
+	defer os.RemoveAll(dir)
+	load := func(config string) (*context, map[string]*pool, error) {
+		file := writeConfig(dir, "127.0.0.1 secret\n", config)
+		conf, _ := goutils.LoadConfig(file, goutils.NewConfigSettings())
+		return loadContext(conf, "", false, false)
+	}
+	ctx, servers, err := load("pools=guest\npool_guest=127.0.0.1:1824\nroute_realm=guest guest strip\nroute=nas-id AP-* guest\n")
+	if err != nil || servers["guest"] == nil || servers[defaultPool] == nil {
+		t.Error("should have loaded the pools", err)
+	}
+	if ctx.routes.String() != "nas-id ap-* -> guest, realm guest -> guest (strip), default -> default" {
+		t.Error("invalid routes", ctx.routes.String())
+	}
+	for _, config := range []string{
+		"pools=default\npool_default=127.0.0.1:1824\n",
+		"pools=guest\n",
+		"route_realm=guest guest\n",
+		"route_default=guest\n",
+		"route=unknown value default\n",
+	} {
+		if _, _, err := load(config); err == nil {
+			t.Error("should be invalid", config)
+		}
+	}
+}
+
+func TestClientSecrets(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "secrets")
+	defer os.RemoveAll(dir)
+	load := func(secrets, config string) (*context, map[string]*pool, error) {
+		file := writeConfig(dir, secrets, config)
+		conf, _ := goutils.LoadConfig(file, goutils.NewConfigSettings())
+		return loadContext(conf, "", false, false)
+	}
+	// no legacy line, the upstream secret is taken from the table
+	ctx, servers, err := load("10.0.0.0/8 nassecret ap\n", "upstream=10.1.1.1:1812\n")
+	if err != nil || len(ctx.secret) != 0 || string(servers[defaultPool].servers[0].secret) != "nassecret" {
+		t.Error("should load without the legacy secret", err)
+	}
+	if _, _, err := load("10.0.0.0/8 nassecret ap\n", "upstream=127.0.0.1:1814\n"); err == nil {
+		t.Error("upstream has no secret")
+	}
+	_, servers, err = load("10.0.0.0/8 nassecret ap\n127.0.0.1 secret\n", "upstream=192.168.1.1:1812\n")
+	if err != nil || string(servers[defaultPool].servers[0].secret) != "secret" {
+		t.Error("should fall back to the legacy secret", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "upstream_secrets"), []byte("127.0.0.1 upstream\n"), 0600)
+	ctx, servers, err = load("10.0.0.0/8 nassecret ap\n", "upstream=127.0.0.1:1814\n")
+	if err != nil || string(servers[defaultPool].servers[0].secret) != "upstream" || ctx.clients.lookup(net.ParseIP("10.1.1.1")) == nil {
+		t.Error("should use the upstream secrets", err)
+	}
+	if _, _, err := load("127.0.0.1 secret\n", "upstream=10.1.1.1:1812\n"); err == nil {
+		t.Error("upstream secrets have no entry for the upstream")
+	}
+}
@@ -7,58 +7,227 @@ import (
 	"github.com/epiphyte/goutils"
 	"github.com/epiphyte/radiucal/plugins"
 	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
 	"os"
 	"strings"
 )
 
+// EAP codes of a success/failure (rfc3748)
+const (
+	eapSuccess = 3
+	eapFailure = 4
+)
+
 type context struct {
-	debug    bool
-	secret   []byte
-	preauths []plugins.PreAuth
-	accts    []plugins.Accounting
-	auths    []plugins.Authing
-	modules  []plugins.Module
+	conf      *goutils.Config
+	debug     bool
+	secret    []byte
+	clients   *clientTable
+	preauths  []plugins.Deciding
+	postauths []plugins.PostAuth
+	accts     []plugins.Accounting
+	auths     []plugins.Authing
+	rewrites  []plugins.Rewriting
+	replies   []plugins.ReplyRewriting
+	modules   []plugins.Module
+	// names of the plugins in use
+	names    []string
 	noreject bool
+	// only acknowledge accounting when all modules succeed
+	ackSuccess bool
+	// send the reason of local rejects (Reply-Message)
+	rejectReason bool
+	// upstream pool selection (auth only)
+	routes *routes
 	// shortcuts
-	preauth bool
-	acct    bool
-	auth    bool
-	module  bool
+	preauth  bool
+	postauth bool
+	acct     bool
+	auth     bool
+	rewrite  bool
+	replying bool
+	module   bool
+}
+
+// use a plugin for each type of action it supports (preauth as loaded, adapted or not)
+func (ctx *context) use(name string, mod plugins.Module) {
+	obj := plugins.Unwrap(mod)
+	if i, ok := obj.(plugins.Accounting); ok {
+		ctx.acct = true
+		ctx.accts = append(ctx.accts, i)
+	}
+	if i, ok := obj.(plugins.Authing); ok {
+		ctx.auth = true
+		ctx.auths = append(ctx.auths, i)
+	}
+	if i := plugins.AsDeciding(mod); i != nil {
+		ctx.preauth = true
+		ctx.preauths = append(ctx.preauths, i)
+	}
+	if i, ok := obj.(plugins.PostAuth); ok {
+		ctx.postauth = true
+		ctx.postauths = append(ctx.postauths, i)
+	}
+	if i, ok := obj.(plugins.Rewriting); ok {
+		ctx.rewrite = true
+		ctx.rewrites = append(ctx.rewrites, i)
+	}
+	if i, ok := obj.(plugins.ReplyRewriting); ok {
+		ctx.replying = true
+		ctx.replies = append(ctx.replies, i)
+	}
+	ctx.modules = append(ctx.modules, obj)
+	ctx.names = append(ctx.names, name)
+	ctx.module = true
+}
+
+// let modules modify a request, when changed it is re-encoded (and signed) for the NAS secret
+func (ctx *context) rewriteRequest(p *radius.Packet, nas *client) ([]byte, error) {
+	if !ctx.rewrite || p == nil {
+		return nil, nil
+	}
+	changed := false
+	for _, mod := range ctx.rewrites {
+		if mod.Rewrite(p) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	return encodeRequest(p, nas.secret)
 }
 
-func (ctx *context) authorize(buffer []byte) bool {
-	valid := true
-	if ctx.preauth || ctx.auth {
-		p, err := ctx.packet(buffer)
-		// we may not be able to always read a packet during conversation
-		// especially during initial EAP phases
-		// we let that go
-		if err == nil {
-			if ctx.preauth {
-				for _, mod := range ctx.preauths {
-					if mod.Pre(p) {
-						continue
-					}
-					valid = false
-					goutils.WriteDebug(fmt.Sprintf("unauthorized (failed: %s)", mod.Name()))
-				}
+// parse an upstream reply and let modules modify it, when changed it is re-encoded (and signed) for the NAS secret,
+// an unparsed reply is relayed as is
+func (ctx *context) rewriteReply(request *radius.Packet, reply []byte, nas *client, requestAuth []byte) (*radius.Packet, []byte, error) {
+	resp, err := ctx.packet(reply, nas)
+	if err != nil {
+		return nil, nil, nil
+	}
+	if !ctx.replying || request == nil {
+		return resp, nil, nil
+	}
+	switch resp.Code {
+	case radius.CodeAccessAccept, radius.CodeAccessReject, radius.CodeAccessChallenge:
+	default:
+		return resp, nil, nil
+	}
+	changed := false
+	for _, mod := range ctx.replies {
+		if mod.RewriteReply(request, resp) {
+			changed = true
+		}
+	}
+	if !changed {
+		return resp, nil, nil
+	}
+	b, err := resp.Encode()
+	if err != nil {
+		return resp, nil, err
+	}
+	signPacket(b, nas.secret, requestAuth)
+	return resp, b, nil
+}
+
+// run preauth/auth modules, the most restrictive decision is taken, nil (unparsed) is let go
+func (ctx *context) decide(p *radius.Packet) *plugins.Decision {
+	decision := &plugins.Decision{Version: plugins.DecisionVersion, Action: plugins.Pass}
+	if p == nil {
+		return decision
+	}
+	if ctx.preauth {
+		for _, mod := range ctx.preauths {
+			d := mod.Decide(p)
+			if d == nil {
+				continue
 			}
-			if ctx.auth {
-				for _, mod := range ctx.auths {
-					mod.Auth(p)
-				}
+			if d.Version > plugins.DecisionVersion {
+				// unknown to us, fail closed
+				goutils.WriteError(fmt.Sprintf("unsupported decision version from %s", mod.Name()), fmt.Errorf("%d", d.Version))
+				d = &plugins.Decision{Action: plugins.Reject, Reason: "unsupported decision"}
 			}
+			if d.Action != plugins.Pass {
+				goutils.WriteDebug(fmt.Sprintf("%s (%s: %s)", d.Action.String(), mod.Name(), d.Reason))
+			}
+			if d.Action > decision.Action {
+				decision = d
+			}
+		}
+	}
+	if ctx.auth {
+		for _, mod := range ctx.auths {
+			mod.Auth(p)
 		}
 	}
-	return valid
+	return decision
 }
 
-func parseSecrets(secretFile string) string {
-	s, err := parseSecretFile(secretFile)
-	if logError("unable to read secrets", err) {
-		panic("unable to read secrets")
+// inform plugins of the reply to a request
+func (ctx *context) postAuthPacket(request, reply *radius.Packet) {
+	if !ctx.postauth || request == nil || reply == nil {
+		return
+	}
+	switch reply.Code {
+	case radius.CodeAccessAccept, radius.CodeAccessReject, radius.CodeAccessChallenge:
+		for _, mod := range ctx.postauths {
+			mod.Post(request, reply)
+		}
+	}
+}
+
+// build the Access-Accept for a Status-Server (rfc5997)
+func (ctx *context) status(buffer []byte, nas *client) ([]byte, error) {
+	p, err := ctx.packet(buffer, nas)
+	if err != nil {
+		return nil, err
+	}
+	resp := response(p, radius.CodeAccessAccept)
+	if err := rfc2869.MessageAuthenticator_Set(resp, make([]byte, authenticatorLength)); err != nil {
+		return nil, err
+	}
+	b, err := resp.Encode()
+	if err != nil {
+		return nil, err
+	}
+	signPacket(b, nas.secret, p.Authenticator[:])
+	return b, nil
+}
+
+// build a local Access-Accept/Reject for a decision, an EAP request gets an EAP-Success/Failure (rfc3579)
+func (ctx *context) localReply(p *radius.Packet, nas *client, d *plugins.Decision) ([]byte, error) {
+	code := radius.CodeAccessReject
+	eap := byte(eapFailure)
+	if d.Action == plugins.Accept {
+		code = radius.CodeAccessAccept
+		eap = eapSuccess
+	}
+	resp := response(p, code)
+	if msg, err := rfc2869.EAPMessage_Lookup(p); err == nil && len(msg) >= 2 {
+		if err := rfc2869.EAPMessage_Set(resp, []byte{eap, msg[1], 0, 4}); err != nil {
+			return nil, err
+		}
+	}
+	if code == radius.CodeAccessReject && ctx.rejectReason && len(d.Reason) > 0 {
+		if err := rfc2865.ReplyMessage_SetString(resp, d.Reason); err != nil {
+			return nil, err
+		}
+	}
+	for t, values := range d.Attributes {
+		for _, v := range values {
+			resp.Add(t, v)
+		}
+	}
+	if err := rfc2869.MessageAuthenticator_Set(resp, make([]byte, authenticatorLength)); err != nil {
+		return nil, err
 	}
-	return s
+	b, err := resp.Encode()
+	if err != nil {
+		return nil, err
+	}
+	signPacket(b, nas.secret, p.Authenticator[:])
+	return b, nil
 }
 
 func parseSecretFile(secretFile string) (string, error) {
@@ -94,19 +263,49 @@ func (ctx *context) reload() {
 	}
 }
 
-func (ctx *context) packet(buffer []byte) (*radius.Packet, error) {
-	return radius.Parse(buffer, []byte(ctx.secret))
+// parse a packet with the secret of the NAS that sent it
+func (ctx *context) packet(buffer []byte, nas *client) (*radius.Packet, error) {
+	if nas == nil {
+		return nil, errors.New("unknown client")
+	}
+	return radius.Parse(buffer, nas.secret)
 }
 
-func (ctx *context) account(buffer []byte) {
-	p, e := ctx.packet(buffer)
-	if e != nil {
-		// unable to parse, exit early
-		return
+// run accounting modules, false if there is no packet or a module failed
+func (ctx *context) accountPacket(p *radius.Packet) bool {
+	if p == nil {
+		return false
 	}
+	success := true
 	if ctx.acct {
 		for _, mod := range ctx.accts {
-			mod.Account(p)
+			if !accountWith(mod, p) {
+				success = false
+			}
+		}
+	}
+	return success
+}
+
+func accountWith(mod plugins.Accounting, p *radius.Packet) (success bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			goutils.WriteError(fmt.Sprintf("accounting failed: %s", mod.Name()), fmt.Errorf("%v", r))
+			success = false
+		}
+	}()
+	if checked, ok := mod.(plugins.AccountingChecked); ok {
+		if err := checked.AccountChecked(p); err != nil {
+			goutils.WriteError(fmt.Sprintf("accounting failed: %s", mod.Name()), err)
+			return false
 		}
+		return true
 	}
+	mod.Account(p)
+	return true
+}
+
+// build the Accounting-Response for an Accounting-Request
+func (ctx *context) acknowledgePacket(p *radius.Packet) ([]byte, error) {
+	return response(p, radius.CodeAccountingResponse).Encode()
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"net"
 	"testing"
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
@@ -11,6 +13,7 @@ type MockModule struct {
 	acct int
 	auth int
 	pre  int
+	post int
 	fail bool
 	reload int
 }
@@ -35,38 +38,46 @@ func (m *MockModule) Auth(p *radius.Packet) {
 	m.auth++
 }
 
+func (m *MockModule) Post(req, resp *radius.Packet) {
+	m.post++
+}
+
 func (m *MockModule) Account(p *radius.Packet) {
 	m.acct++
+	if m.fail {
+		panic("accounting failed")
+	}
 }
 
 func TestAuthNoMods(t *testing.T) {
 	ctx := &context{}
-	if !ctx.authorize(nil) {
+	if ctx.decide(nil).Action != plugins.Pass {
 		t.Error("should have passed, nothing to do")
 	}
 }
 
 func TestAuth(t *testing.T) {
-	ctx, p := getPacket(t)
+	ctx, b := getPacket(t)
+	p, _ := ctx.packet(b, localNAS(ctx))
 	m := &MockModule{}
 	ctx.auths = append(ctx.auths, m)
 	ctx.auth = true
 	// invalid packet
-	if !ctx.authorize(nil) {
+	if ctx.decide(nil).Action != plugins.Pass {
 		t.Error("didn't authorize")
 	}
 	if m.auth != 0 {
 		t.Error("did auth")
 	}
-	if !ctx.authorize(p) {
+	if ctx.decide(p).Action != plugins.Pass {
 		t.Error("didn't authorize")
 	}
 	if m.auth != 1 {
 		t.Error("didn't auth")
 	}
 	ctx.preauth = true
-	ctx.preauths = append(ctx.preauths, m)
-	if !ctx.authorize(p) {
+	ctx.preauths = append(ctx.preauths, plugins.AsDeciding(m))
+	if ctx.decide(p).Action != plugins.Pass {
 		t.Error("didn't authorize")
 	}
 	if m.auth != 2 {
@@ -76,7 +87,7 @@ func TestAuth(t *testing.T) {
 		t.Error("didn't preauth")
 	}
 	m.fail = true
-	if ctx.authorize(p) {
+	if ctx.decide(p).Action != plugins.Reject {
 		t.Error("did authorize")
 	}
 	if m.auth != 3 {
@@ -86,7 +97,7 @@ func TestAuth(t *testing.T) {
 		t.Error("didn't preauth")
 	}
 	ctx.auth = false
-	if ctx.authorize(p) {
+	if ctx.decide(p).Action != plugins.Reject {
 		t.Error("did authorize")
 	}
 	if m.auth != 3 {
@@ -100,6 +111,8 @@ func TestAuth(t *testing.T) {
 func getPacket(t *testing.T) (*context, []byte) {
 	c := &context{}
 	c.secret = []byte("secret")
+	local, _ := parseNetwork("127.0.0.1")
+	c.clients = &clientTable{entries: []*client{&client{network: local, secret: c.secret}}}
     p := radius.New(radius.CodeAccessRequest, c.secret)
     if err := rfc2865.UserName_AddString(p, "user"); err != nil {
         t.Error("unable to add user name")
@@ -114,6 +127,10 @@ func getPacket(t *testing.T) (*context, []byte) {
 	return c, b
 }
 
+func localNAS(ctx *context) *client {
+	return ctx.clients.lookup(net.ParseIP("127.0.0.1"))
+}
+
 func TestSecretParsing(t *testing.T) {
 	dir := "./tests/"
 	_, err := parseSecretFile(dir + "nofile")
@@ -157,24 +174,173 @@ func TestReload(t *testing.T) {
 
 func TestAcctNoMods(t *testing.T) {
 	ctx := &context{}
-	ctx.account(nil)
+	ctx.accountPacket(nil)
 }
 
 func TestAcct(t *testing.T) {
-	ctx, p := getPacket(t)
+	ctx, b := getPacket(t)
+	p, _ := ctx.packet(b, localNAS(ctx))
 	m := &MockModule{}
-	ctx.account(nil)
+	ctx.accountPacket(p)
 	if m.acct != 0 {
 		t.Error("didn't account")
 	}
 	ctx.acct = true
 	ctx.accts = append(ctx.accts, m)
-	ctx.account(p)
+	if !ctx.accountPacket(p) {
+		t.Error("should have succeeded")
+	}
 	if m.acct != 1 {
 		t.Error("didn't account")
 	}
-	ctx.account(p)
+	ctx.accountPacket(p)
 	if m.acct != 2 {
 		t.Error("didn't account")
 	}
+	m.fail = true
+	if ctx.accountPacket(p) {
+		t.Error("should have failed")
+	}
+	if ctx.accountPacket(nil) {
+		t.Error("invalid packet")
+	}
+}
+
+type CheckedModule struct {
+	MockModule
+	checked int
+	err     error
+}
+
+func (m *CheckedModule) AccountChecked(p *radius.Packet) error {
+	m.checked++
+	return m.err
+}
+
+func TestAcctChecked(t *testing.T) {
+	ctx, b := getPacket(t)
+	p, _ := ctx.packet(b, localNAS(ctx))
+	m := &CheckedModule{}
+	ctx.acct = true
+	ctx.accts = append(ctx.accts, m)
+	if !ctx.accountPacket(p) {
+		t.Error("should have succeeded")
+	}
+	m.err = errors.New("unable to write")
+	if ctx.accountPacket(p) {
+		t.Error("should have failed")
+	}
+	if m.checked != 2 || m.acct != 0 {
+		t.Error("should only use the checked accounting")
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+	ctx, _ := getPacket(t)
+	nas := localNAS(ctx)
+	p := radius.New(radius.CodeAccountingRequest, nas.secret)
+	rfc2865.ProxyState_Add(p, []byte("proxied"))
+	b, _ := p.Encode()
+	if !validRequest(b, nas.secret) {
+		t.Error("should be a valid request")
+	}
+	req, _ := ctx.packet(b, nas)
+	resp, err := ctx.acknowledgePacket(req)
+	if err != nil {
+		t.Error("unable to acknowledge")
+	}
+	if radius.Code(resp[0]) != radius.CodeAccountingResponse || resp[1] != b[1] {
+		t.Error("not a response to the request")
+	}
+	if !validResponse(resp, b[4:20], nas.secret) {
+		t.Error("invalid response authenticator")
+	}
+	r, _ := ctx.packet(resp, nas)
+	if string(rfc2865.ProxyState_Get(r)) != "proxied" {
+		t.Error("proxy state not copied")
+	}
+}
+
+func TestPostAuth(t *testing.T) {
+	ctx, b := getPacket(t)
+	m := &MockModule{}
+	nas := localNAS(ctx)
+	req, _ := ctx.packet(b, nas)
+	accept := req.Response(radius.CodeAccessAccept)
+	ctx.postAuthPacket(req, accept)
+	if m.post != 0 {
+		t.Error("no postauth modules")
+	}
+	ctx.postauth = true
+	ctx.postauths = append(ctx.postauths, m)
+	ctx.postAuthPacket(req, accept)
+	if m.post != 1 {
+		t.Error("didn't postauth")
+	}
+	ctx.postAuthPacket(nil, accept)
+	acct := req.Response(radius.CodeAccountingResponse)
+	ctx.postAuthPacket(req, acct)
+	if m.post != 1 {
+		t.Error("should only postauth access replies")
+	}
+}
+
+type DecidingModule struct {
+	MockModule
+	decision *plugins.Decision
+}
+
+func (m *DecidingModule) Decide(p *radius.Packet) *plugins.Decision {
+	m.pre++
+	return m.decision
+}
+
+func TestDecide(t *testing.T) {
+	ctx, b := getPacket(t)
+	p, _ := ctx.packet(b, localNAS(ctx))
+	if ctx.decide(p).Action != plugins.Pass || ctx.decide(nil).Action != plugins.Pass {
+		t.Error("should pass without modules")
+	}
+	accept := &DecidingModule{decision: &plugins.Decision{Action: plugins.Accept, Reason: "accepted"}}
+	pass := &DecidingModule{}
+	ctx.use("accept", accept)
+	ctx.use("pass", pass)
+	if d := ctx.decide(p); d.Action != plugins.Accept || d.Reason != "accepted" {
+		t.Error("should accept")
+	}
+	legacy := &MockModule{fail: true}
+	ctx.use("legacy", legacy)
+	if d := ctx.decide(p); d.Action != plugins.Reject || d.Reason != "failed: mock" {
+		t.Error("should reject (via the adapter)", d)
+	}
+	drop := &DecidingModule{decision: &plugins.Decision{Action: plugins.Drop}}
+	ctx.use("drop", drop)
+	if ctx.decide(p).Action != plugins.Drop {
+		t.Error("should drop")
+	}
+	if accept.pre != 3 || pass.pre != 3 || legacy.pre != 2 || drop.pre != 1 {
+		t.Error("all modules should decide")
+	}
+	ctx, _ = getPacket(t)
+	ctx.use("future", &DecidingModule{decision: &plugins.Decision{Version: plugins.DecisionVersion + 1, Action: plugins.Accept}})
+	if ctx.decide(p).Action != plugins.Reject {
+		t.Error("unsupported versions should reject")
+	}
+	if plugins.AsDeciding(&MockModule{}) == nil || plugins.AsDeciding(&DecidingModule{}) == nil {
+		t.Error("should be deciders")
+	}
+	// as loaded, a legacy module is adapted but keeps its other interfaces
+	legacy = &MockModule{}
+	adapted := plugins.AsDeciding(legacy)
+	if plugins.AsDeciding(adapted) != adapted || plugins.Unwrap(adapted) != legacy {
+		t.Error("should be the same view")
+	}
+	ctx = &context{}
+	ctx.use("legacy", adapted)
+	if len(ctx.preauths) != 1 || len(ctx.accts) != 1 || len(ctx.auths) != 1 || len(ctx.postauths) != 1 {
+		t.Error("should be used for each action")
+	}
+	if len(ctx.modules) != 1 || ctx.modules[0] != legacy {
+		t.Error("should use the plugin")
+	}
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/rfc2869"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const controlUsage = "disconnect <user|-> [mac] | coa <user|-> <mac|-> <type>=<value>..."
+
+// operator commands (one line per connection) on a unix socket
+func listenControl(path string) (net.Listener, error) {
+	if goutils.PathExists(path) {
+		// stale socket from a previous run
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func runControl(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logError("control accept", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Duration(coaRetries+1)*coaTimeout + 10*time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(conn, command(strings.TrimSpace(line)))
+		}()
+	}
+}
+
+// run an operator command, the result is a single line
+func command(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return fmt.Sprintf("error: usage: %s", controlUsage)
+	}
+	user := fields[1]
+	if user == "-" {
+		user = ""
+	}
+	mac := ""
+	if len(fields) > 2 && fields[2] != "-" {
+		mac = fields[2]
+	}
+	d := &dynamicAuth{}
+	var count int
+	var err error
+	switch fields[0] {
+	case "disconnect":
+		if len(fields) > 3 {
+			return fmt.Sprintf("error: usage: %s", controlUsage)
+		}
+		count, err = d.Disconnect(user, mac)
+	case "coa":
+		if len(fields) < 4 {
+			return fmt.Sprintf("error: usage: %s", controlUsage)
+		}
+		attrs, perr := parseAttributes(fields[3:])
+		if perr != nil {
+			return fmt.Sprintf("error: %s", perr)
+		}
+		count, err = d.Change(user, mac, attrs)
+	default:
+		return fmt.Sprintf("error: usage: %s", controlUsage)
+	}
+	goutils.WriteInfo("control", line)
+	if err != nil {
+		return fmt.Sprintf("error: %s (%d session(s) done)", err, count)
+	}
+	return fmt.Sprintf("ok: %d session(s)", count)
+}
+
+// attribute types (by dictionary) that are not strings
+var (
+	integerAttributes = []radius.Type{
+		rfc2865.NASPort_Type,
+		rfc2865.ServiceType_Type,
+		rfc2865.FramedProtocol_Type,
+		rfc2865.FramedRouting_Type,
+		rfc2865.FramedMTU_Type,
+		rfc2865.FramedCompression_Type,
+		rfc2865.LoginService_Type,
+		rfc2865.LoginTCPPort_Type,
+		rfc2865.FramedIPXNetwork_Type,
+		rfc2865.SessionTimeout_Type,
+		rfc2865.IdleTimeout_Type,
+		rfc2865.TerminationAction_Type,
+		rfc2865.FramedAppleTalkLink_Type,
+		rfc2865.FramedAppleTalkNetwork_Type,
+		rfc2865.NASPortType_Type,
+		rfc2865.PortLimit_Type,
+		// tagged (tag 0)
+		rfc2868.TunnelType_Type,
+		rfc2868.TunnelMediumType_Type,
+		rfc2869.AcctInterimInterval_Type,
+	}
+	addressAttributes = []radius.Type{
+		rfc2865.NASIPAddress_Type,
+		rfc2865.FramedIPAddress_Type,
+		rfc2865.FramedIPNetmask_Type,
+		rfc2865.LoginIPHost_Type,
+	}
+)
+
+func hasType(types []radius.Type, t radius.Type) bool {
+	for _, check := range types {
+		if check == t {
+			return true
+		}
+	}
+	return false
+}
+
+// attributes given as <type>=<value>, encoded by the dictionary type (integer, address) or as strings
+func parseAttributes(pairs []string) (radius.Attributes, error) {
+	attrs := make(radius.Attributes)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("invalid attribute: %s", pair))
+		}
+		t, err := strconv.Atoi(parts[0])
+		if err != nil || t <= 0 || t > 255 {
+			return nil, errors.New(fmt.Sprintf("invalid attribute type: %s", parts[0]))
+		}
+		var value radius.Attribute
+		switch {
+		case hasType(integerAttributes, radius.Type(t)):
+			i, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid integer attribute: %s", pair))
+			}
+			value = radius.NewInteger(uint32(i))
+		case hasType(addressAttributes, radius.Type(t)):
+			value, err = radius.NewIPAddr(net.ParseIP(parts[1]))
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid address attribute: %s", pair))
+			}
+		default:
+			value, err = radius.NewString(parts[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		attrs.Add(radius.Type(t), value)
+	}
+	return attrs, nil
+}
+
+// send a command to the running instance (for operators)
+func sendCommand(path, line string) (string, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, line); err != nil {
+		return "", err
+	}
+	result, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(result), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	duplicates map[string]*duplicate = make(map[string]*duplicate)
+	dupLock    *sync.Mutex           = new(sync.Mutex)
+	dupWindow  time.Duration         = 10 * time.Second
+)
+
+// request seen recently (rfc5080 2.2.2), reply is nil while in flight
+type duplicate struct {
+	reply []byte
+	seen  time.Time
+}
+
+// duplicate key: source, identifier, and request authenticator
+func requestKey(addr net.Addr, buffer []byte) string {
+	if len(buffer) < 20 {
+		return ""
+	}
+	return clientKey(addr) + string(buffer[1:2]) + string(buffer[4:20])
+}
+
+// check if a request was already seen (returning any cached reply), otherwise track it as in flight
+func checkDuplicate(key string, now time.Time) ([]byte, bool) {
+	if dupWindow <= 0 || len(key) == 0 {
+		return nil, false
+	}
+	dupLock.Lock()
+	defer dupLock.Unlock()
+	if d, ok := duplicates[key]; ok && now.Sub(d.seen) < dupWindow {
+		return d.reply, true
+	}
+	duplicates[key] = &duplicate{seen: now}
+	return nil, false
+}
+
+// cache the reply sent for a request
+func cacheReply(key string, reply []byte) {
+	if dupWindow <= 0 || len(key) == 0 {
+		return
+	}
+	dupLock.Lock()
+	defer dupLock.Unlock()
+	d, ok := duplicates[key]
+	if !ok {
+		return
+	}
+	d.reply = make([]byte, len(reply))
+	copy(d.reply, reply)
+}
+
+// forget a request in flight that will not be answered, a retransmission is handled again
+func forgetDuplicate(key string) {
+	if dupWindow <= 0 || len(key) == 0 {
+		return
+	}
+	dupLock.Lock()
+	defer dupLock.Unlock()
+	if d, ok := duplicates[key]; ok && d.reply == nil {
+		delete(duplicates, key)
+	}
+}
+
+func evictDuplicates(now time.Time) {
+	dupLock.Lock()
+	defer dupLock.Unlock()
+	for k, d := range duplicates {
+		if now.Sub(d.seen) >= dupWindow {
+			delete(duplicates, k)
+		}
+	}
+}
+
+func expireDuplicates() {
+	for now := range time.Tick(dupWindow) {
+		evictDuplicates(now)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/epiphyte/radiucal/plugins"
+	"layeh.com/radius"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDuplicates(t *testing.T) {
+	dupWindow = 10 * time.Second
+	_, b := getPacket(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10000}
+	key := requestKey(addr, b)
+	if requestKey(addr, nil) != "" {
+		t.Error("invalid packet has no key")
+	}
+	other := requestKey(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10001}, b)
+	if key == other {
+		t.Error("different sources")
+	}
+	now := time.Now()
+	if _, ok := checkDuplicate(key, now); ok {
+		t.Error("first time seen")
+	}
+	reply, ok := checkDuplicate(key, now)
+	if !ok || reply != nil {
+		t.Error("should be in flight")
+	}
+	cacheReply(key, []byte("reply"))
+	reply, ok = checkDuplicate(key, now)
+	if !ok || string(reply) != "reply" {
+		t.Error("should have cached reply")
+	}
+	if _, ok := checkDuplicate(key, now.Add(dupWindow)); ok {
+		t.Error("should have expired")
+	}
+	evictDuplicates(now.Add(2 * dupWindow))
+	if len(duplicates) != 0 {
+		t.Error("should have evicted")
+	}
+	cacheReply(key, []byte("reply"))
+	if len(duplicates) != 0 {
+		t.Error("not tracked, nothing to cache")
+	}
+	dupWindow = 0
+	checkDuplicate(key, now)
+	if _, ok := checkDuplicate(key, now); ok {
+		t.Error("duplicate detection disabled")
+	}
+}
+
+func TestRetransmitDropped(t *testing.T) {
+	closeClients()
+	window := dupWindow
+	dupWindow = 10 * time.Second
+	defer func() { dupWindow = window }()
+	ctx, request := getPacket(t)
+	m := &DecidingModule{decision: &plugins.Decision{Action: plugins.Drop}}
+	ctx.use("decide", m)
+	cli := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10003}
+	var sent [][]byte
+	send := func(b []byte) error {
+		sent = append(sent, b)
+		return nil
+	}
+	authenticate(ctx, request, cli, localNAS(ctx), send)
+	m.decision = &plugins.Decision{Action: plugins.Reject}
+	// the retransmission is not a duplicate of the dropped request
+	authenticate(ctx, request, cli, localNAS(ctx), send)
+	if m.pre != 2 || len(sent) != 1 || radius.Code(sent[0][0]) != radius.CodeAccessReject {
+		t.Error("should have handled the retransmission", m.pre, len(sent))
+	}
+	// a retransmission of the answered request is
+	authenticate(ctx, request, cli, localNAS(ctx), send)
+	if m.pre != 2 || len(sent) != 2 || radius.Code(sent[1][0]) != radius.CodeAccessReject {
+		t.Error("should have answered from the cache")
+	}
+	closeClients()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc3576"
+	"net"
+	"time"
+)
+
+var (
+	// dynamic authorization (rfc5176) port, timeout and retries
+	coaPort    int           = 3799
+	coaTimeout time.Duration = 3 * time.Second
+	coaRetries int           = 2
+)
+
+// build the Disconnect-Request/CoA-Request identifying a session
+func (s *session) packet(code radius.Code, attrs radius.Attributes) ([]byte, error) {
+	p := radius.New(code, s.nas.secret)
+	rfc2866.AcctSessionID_SetString(p, s.id)
+	if len(s.user) > 0 {
+		rfc2865.UserName_SetString(p, s.user)
+	}
+	if len(s.calling) > 0 {
+		rfc2865.CallingStationID_SetString(p, s.calling)
+	}
+	if s.nasIP != nil {
+		rfc2865.NASIPAddress_Set(p, s.nasIP)
+	}
+	if len(s.nasID) > 0 {
+		rfc2865.NASIdentifier_SetString(p, s.nasID)
+	}
+	for t, values := range attrs {
+		for _, v := range values {
+			p.Add(t, v)
+		}
+	}
+	return p.Encode()
+}
+
+// send a request to the NAS of a session, retried until it is acknowledged (or refused)
+func (s *session) request(code radius.Code, attrs radius.Attributes) error {
+	b, err := s.packet(code, attrs)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: s.addr, Port: coaPort})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var buffer [radius.MaxPacketLength]byte
+	for attempt := 0; attempt <= coaRetries; attempt++ {
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(coaTimeout))
+		for {
+			n, err := conn.Read(buffer[0:])
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				return err
+			}
+			resp := buffer[0:n]
+			if n < 20 || resp[1] != b[1] || !validResponse(resp, b[4:20], s.nas.secret) {
+				goutils.WriteDebug("invalid dynamic authorization reply", s.addr.String())
+				continue
+			}
+			return nak(resp, s.nas.secret)
+		}
+		goutils.WriteDebug("no dynamic authorization reply", s.addr.String(), fmt.Sprintf("%d", attempt))
+	}
+	return errors.New(fmt.Sprintf("no reply from %s", s.addr.String()))
+}
+
+// error (with the Error-Cause if given) for a NAK, nil for an ACK
+func nak(b, secret []byte) error {
+	switch radius.Code(b[0]) {
+	case radius.CodeDisconnectACK, radius.CodeCoAACK:
+		return nil
+	case radius.CodeDisconnectNAK, radius.CodeCoANAK:
+		cause := "unknown"
+		if p, err := radius.Parse(b, secret); err == nil {
+			if c, err := rfc3576.ErrorCause_Lookup(p); err == nil {
+				cause = c.String()
+			}
+		}
+		return errors.New(fmt.Sprintf("%s (%s)", radius.Code(b[0]).String(), cause))
+	}
+	return errors.New(fmt.Sprintf("unexpected reply: %s", radius.Code(b[0]).String()))
+}
+
+// rfc5176 client for plugins and operators, requests go to every matching session
+type dynamicAuth struct {
+}
+
+// disconnect the sessions of a user and/or mac
+func (d *dynamicAuth) Disconnect(user, mac string) (int, error) {
+	return d.send(radius.CodeDisconnectRequest, user, mac, nil)
+}
+
+// change the authorization of the sessions of a user and/or mac
+func (d *dynamicAuth) Change(user, mac string, attrs radius.Attributes) (int, error) {
+	return d.send(radius.CodeCoARequest, user, mac, attrs)
+}
+
+func (d *dynamicAuth) send(code radius.Code, user, mac string, attrs radius.Attributes) (int, error) {
+	found := findSessions(user, mac)
+	if len(found) == 0 {
+		return 0, errors.New("no sessions found")
+	}
+	var failed error
+	count := 0
+	for _, s := range found {
+		err := s.request(code, attrs)
+		if err != nil {
+			goutils.WriteError(fmt.Sprintf("%s failed for %s", code.String(), s.id), err)
+			failed = err
+			continue
+		}
+		goutils.WriteInfo(code.String(), s.id, s.user, s.addr.String())
+		if code == radius.CodeDisconnectRequest {
+			forgetSession(s)
+		}
+		count++
+	}
+	return count, failed
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io/ioutil"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc3576"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func accountingPacket(t *testing.T, status rfc2866.AcctStatusType, id string) *radius.Packet {
+	p := radius.New(radius.CodeAccountingRequest, []byte("secret"))
+	rfc2866.AcctStatusType_Set(p, status)
+	rfc2866.AcctSessionID_SetString(p, id)
+	rfc2865.UserName_SetString(p, "user")
+	rfc2865.CallingStationID_SetString(p, "11-22-33-44-55-66")
+	return p
+}
+
+// answers dynamic authorization requests (ignoring the first ones given)
+func fakeNAS(t *testing.T, ignore int, reply radius.Code, cause rfc3576.ErrorCause) (*net.UDPConn, chan *radius.Packet) {
+	nas, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal("unable to listen", err)
+	}
+	coaPort = nas.LocalAddr().(*net.UDPAddr).Port
+	received := make(chan *radius.Packet, 10)
+	go func() {
+		var buffer [radius.MaxPacketLength]byte
+		for {
+			n, addr, err := nas.ReadFromUDP(buffer[0:])
+			if err != nil {
+				return
+			}
+			p, err := radius.Parse(buffer[0:n], []byte("secret"))
+			if err != nil || !radius.IsAuthenticRequest(buffer[0:n], []byte("secret")) {
+				continue
+			}
+			received <- p
+			if ignore > 0 {
+				ignore--
+				continue
+			}
+			resp := p.Response(reply)
+			if cause > 0 {
+				rfc3576.ErrorCause_Set(resp, cause)
+			}
+			b, _ := resp.Encode()
+			nas.WriteToUDP(b, addr)
+		}
+	}()
+	return nas, received
+}
+
+func TestTrackSession(t *testing.T) {
+	sessions = make(map[string]*session)
+	ctx, _ := getPacket(t)
+	nas := localNAS(ctx)
+	local := net.ParseIP("127.0.0.1")
+	now := time.Now()
+	trackSession(accountingPacket(t, rfc2866.AcctStatusType_Value_Start, "1"), nas, local, now)
+	trackSession(accountingPacket(t, rfc2866.AcctStatusType_Value_InterimUpdate, "2"), nas, local, now)
+	if len(sessions) != 2 || len(findSessions("user", "")) != 2 || len(findSessions("", "112233445566")) != 2 {
+		t.Error("should track sessions")
+	}
+	if len(findSessions("other", "11:22:33:44:55:66")) != 0 || len(findSessions("", "")) != 0 || len(findSessions("", "zz")) != 0 || len(findSessions("user", "zz")) != 0 {
+		t.Error("should only find matching sessions")
+	}
+	trackSession(accountingPacket(t, rfc2866.AcctStatusType_Value_Stop, "1"), nas, local, now)
+	if len(sessions) != 1 {
+		t.Error("should have stopped the session")
+	}
+	evictSessions(now.Add(sessionTimeout))
+	if len(sessions) != 0 {
+		t.Error("should have expired the session")
+	}
+	trackSession(accountingPacket(t, rfc2866.AcctStatusType_Value_Start, "1"), nas, local, now)
+	trackSession(accountingPacket(t, rfc2866.AcctStatusType_Value_AccountingOn, ""), nas, local, now)
+	if len(sessions) != 0 {
+		t.Error("should have dropped the sessions of the NAS")
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	sessions = make(map[string]*session)
+	ctx, _ := getPacket(t)
+	nas, received := fakeNAS(t, 1, radius.CodeDisconnectACK, 0)
+	defer nas.Close()
+	coaTimeout = 100 * time.Millisecond
+	trackSession(accountingPacket(t, rfc2866.AcctStatusType_Value_Start, "1"), localNAS(ctx), net.ParseIP("127.0.0.1"), time.Now())
+	d := &dynamicAuth{}
+	count, err := d.Disconnect("user", "")
+	if err != nil || count != 1 {
+		t.Error("should have disconnected after a retry", err)
+	}
+	p := <-received
+	if id, _ := rfc2866.AcctSessionID_LookupString(p); p.Code != radius.CodeDisconnectRequest || id != "1" {
+		t.Error("invalid request")
+	}
+	if len(sessions) != 0 {
+		t.Error("should have forgotten the session")
+	}
+	if _, err := d.Disconnect("user", ""); err == nil {
+		t.Error("no sessions remain")
+	}
+	coaTimeout = 3 * time.Second
+}
+
+func TestChangeRefused(t *testing.T) {
+	sessions = make(map[string]*session)
+	ctx, _ := getPacket(t)
+	nas, received := fakeNAS(t, 0, radius.CodeCoANAK, rfc3576.ErrorCause_Value_SessionContextNotFound)
+	defer nas.Close()
+	trackSession(accountingPacket(t, rfc2866.AcctStatusType_Value_Start, "1"), localNAS(ctx), net.ParseIP("127.0.0.1"), time.Now())
+	attrs, err := parseAttributes([]string{"27=3600", "11=filter", "81=20", "8=10.0.0.2"})
+	if err != nil {
+		t.Error("should parse attributes", err)
+	}
+	if string(attrs[81][0]) != "20" || len(attrs[8][0]) != 4 {
+		t.Error("should encode by attribute type")
+	}
+	for _, invalid := range []string{"27=never", "8=host", "256=1", "27"} {
+		if _, err := parseAttributes([]string{invalid}); err == nil {
+			t.Error("should be invalid", invalid)
+		}
+	}
+	count, err := (&dynamicAuth{}).Change("", "112233445566", attrs)
+	if err == nil || count != 0 || !strings.Contains(err.Error(), "Session-Context-Not-Found") {
+		t.Error("should have been refused", err)
+	}
+	p := <-received
+	if timeout, _ := rfc2865.SessionTimeout_Lookup(p); p.Code != radius.CodeCoARequest || timeout != 3600 || rfc2865.FilterID_GetString(p) != "filter" {
+		t.Error("invalid request")
+	}
+	if len(sessions) != 1 {
+		t.Error("should keep the session")
+	}
+	sessions = make(map[string]*session)
+}
+
+func TestControl(t *testing.T) {
+	sessions = make(map[string]*session)
+	ctx, _ := getPacket(t)
+	nas, _ := fakeNAS(t, 0, radius.CodeDisconnectACK, 0)
+	defer nas.Close()
+	dir, _ := ioutil.TempDir("", "control")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control")
+	listener, err := listenControl(path)
+	if err != nil {
+		t.Fatal("unable to listen", err)
+	}
+	defer listener.Close()
+	go runControl(listener)
+	trackSession(accountingPacket(t, rfc2866.AcctStatusType_Value_Start, "1"), localNAS(ctx), net.ParseIP("127.0.0.1"), time.Now())
+	for _, c := range []string{"", "disconnect", "unknown user", "coa user -", "coa user - 300=1", "disconnect - zz", "coa user - 27=never"} {
+		if result, _ := sendCommand(path, c); !strings.HasPrefix(result, "error") {
+			t.Error("should be invalid", c, result)
+		}
+	}
+	if result, err := sendCommand(path, "disconnect user 11:22:33:44:55:66"); err != nil || result != "ok: 1 session(s)" {
+		t.Error("should have disconnected", result, err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+const authenticatorLength = 16
+
+// walk the attributes of an encoded packet until the function returns false
+func walkAttributes(b []byte, fn func(t radius.Type, value []byte) bool) {
+	if len(b) < 20 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length > len(b) {
+		return
+	}
+	for idx := 20; idx+2 <= length; {
+		size := int(b[idx+1])
+		if size < 2 || idx+size > length {
+			return
+		}
+		if !fn(radius.Type(b[idx]), b[idx+2:idx+size]) {
+			return
+		}
+		idx += size
+	}
+}
+
+// get the offset of the (first) value of an attribute in an encoded packet, -1 if not found
+func attributeOffset(b []byte, t radius.Type) int {
+	offset := -1
+	idx := 20
+	walkAttributes(b, func(typed radius.Type, value []byte) bool {
+		if typed == t {
+			offset = idx + 2
+			return false
+		}
+		idx += len(value) + 2
+		return true
+	})
+	return offset
+}
+
+func isRequest(code radius.Code) bool {
+	switch code {
+	case radius.CodeAccessRequest, radius.CodeStatusServer, radius.CodeAccountingRequest, radius.CodeDisconnectRequest, radius.CodeCoARequest:
+		return true
+	}
+	return false
+}
+
+// sign an encoded packet in place: sets the Message-Authenticator (if present)
+// and the authenticator. For responses the authenticator of the request must be given
+func signPacket(b, secret, requestAuth []byte) {
+	code := radius.Code(b[0])
+	random := code == radius.CodeAccessRequest || code == radius.CodeStatusServer
+	if !random {
+		if isRequest(code) {
+			copy(b[4:20], make([]byte, authenticatorLength))
+		} else {
+			copy(b[4:20], requestAuth)
+		}
+	}
+	offset := attributeOffset(b, rfc2869.MessageAuthenticator_Type)
+	if offset > 0 && offset+authenticatorLength <= len(b) {
+		ma := b[offset : offset+authenticatorLength]
+		copy(ma, make([]byte, authenticatorLength))
+		hash := hmac.New(md5.New, secret)
+		hash.Write(b)
+		copy(ma, hash.Sum(nil))
+	}
+	if random {
+		return
+	}
+	hash := md5.New()
+	hash.Write(b)
+	hash.Write(secret)
+	copy(b[4:20], hash.Sum(nil))
+}
+
+// copy a packet (and its attributes) to change it without changing the original
+func copyPacket(p *radius.Packet) *radius.Packet {
+	copied := *p
+	copied.Attributes = make(radius.Attributes)
+	for t, values := range p.Attributes {
+		copied.Attributes[t] = append([]radius.Attribute(nil), values...)
+	}
+	return &copied
+}
+
+// encode a (modified) request and sign it, the authenticator of an Access-Request is kept
+func encodeRequest(p *radius.Packet, secret []byte) ([]byte, error) {
+	b, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+	signPacket(b, secret, nil)
+	return b, nil
+}
+
+// check a response was signed with the secret for the given request authenticator
+func validResponse(response, requestAuth, secret []byte) bool {
+	if len(response) < 20 || len(requestAuth) != authenticatorLength {
+		return false
+	}
+	hash := md5.New()
+	hash.Write(response[:4])
+	hash.Write(requestAuth)
+	hash.Write(response[20:])
+	hash.Write(secret)
+	return bytes.Equal(hash.Sum(nil), response[4:20])
+}
+
+// check an accounting request was signed with the secret
+func validRequest(request, secret []byte) bool {
+	if len(request) < 20 {
+		return false
+	}
+	hash := md5.New()
+	hash.Write(request[:4])
+	hash.Write(make([]byte, authenticatorLength))
+	hash.Write(request[20:])
+	hash.Write(secret)
+	return bytes.Equal(hash.Sum(nil), request[4:20])
+}
+
+// create a response to a request, Proxy-State attributes are copied (rfc2865)
+func response(p *radius.Packet, code radius.Code) *radius.Packet {
+	resp := p.Response(code)
+	for _, a := range p.Attributes[rfc2865.ProxyState_Type] {
+		resp.Add(rfc2865.ProxyState_Type, a)
+	}
+	return resp
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"github.com/epiphyte/radiucal/plugins"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+	"testing"
+)
+
+func TestAttributeOffset(t *testing.T) {
+	_, b := getPacket(t)
+	if attributeOffset(nil, rfc2865.UserName_Type) != -1 {
+		t.Error("invalid packet has no attributes")
+	}
+	offset := attributeOffset(b, rfc2865.UserName_Type)
+	if offset < 0 || string(b[offset:offset+4]) != "user" {
+		t.Error("unable to find user name")
+	}
+	if attributeOffset(b, rfc2865.State_Type) != -1 {
+		t.Error("state is not in the packet")
+	}
+}
+
+func TestSignResponse(t *testing.T) {
+	ctx, b := getPacket(t)
+	req, _ := ctx.packet(b, localNAS(ctx))
+	resp := req.Response(radius.CodeAccessAccept)
+	expect, err := resp.Encode()
+	if err != nil {
+		t.Error("unable to encode")
+	}
+	signed := make([]byte, len(expect))
+	copy(signed, expect)
+	signPacket(signed, ctx.secret, req.Authenticator[:])
+	if !bytes.Equal(signed, expect) {
+		t.Error("response authenticator differs")
+	}
+	if !validResponse(signed, b[4:20], ctx.secret) {
+		t.Error("should be a valid response")
+	}
+	if validResponse(signed, b[4:20], []byte("other")) {
+		t.Error("wrong secret")
+	}
+}
+
+func TestSignMessageAuthenticator(t *testing.T) {
+	ctx, b := getPacket(t)
+	req, _ := ctx.packet(b, localNAS(ctx))
+	resp := req.Response(radius.CodeAccessReject)
+	rfc2869.MessageAuthenticator_Set(resp, make([]byte, authenticatorLength))
+	signed, _ := resp.Encode()
+	signPacket(signed, ctx.secret, req.Authenticator[:])
+	if !validResponse(signed, b[4:20], ctx.secret) {
+		t.Error("should be a valid response")
+	}
+	if !validMessageAuthenticator(signed, req.Authenticator[:], ctx.secret) {
+		t.Error("invalid message authenticator")
+	}
+}
+
+func validMessageAuthenticator(signed, requestAuth, secret []byte) bool {
+	offset := attributeOffset(signed, rfc2869.MessageAuthenticator_Type)
+	if offset < 0 {
+		return false
+	}
+	check := make([]byte, len(signed))
+	copy(check, signed)
+	copy(check[4:20], requestAuth)
+	copy(check[offset:offset+authenticatorLength], make([]byte, authenticatorLength))
+	hash := hmac.New(md5.New, secret)
+	hash.Write(check)
+	return bytes.Equal(hash.Sum(nil), signed[offset:offset+authenticatorLength])
+}
+
+func TestRejection(t *testing.T) {
+	ctx, b := getPacket(t)
+	nas := localNAS(ctx)
+	req, _ := ctx.packet(b, nas)
+	rfc2865.ProxyState_Add(req, []byte("proxied"))
+	denied := &plugins.Decision{Action: plugins.Reject, Reason: "denied"}
+	rej, err := ctx.localReply(req, nas, denied)
+	if err != nil || radius.Code(rej[0]) != radius.CodeAccessReject || rej[1] != b[1] {
+		t.Error("not a reject for the request", err)
+	}
+	if !validResponse(rej, b[4:20], nas.secret) || !validMessageAuthenticator(rej, b[4:20], nas.secret) {
+		t.Error("invalid reject signature")
+	}
+	p, _ := ctx.packet(rej, nas)
+	if _, err := rfc2869.EAPMessage_Lookup(p); err == nil {
+		t.Error("not an EAP request")
+	}
+	if _, err := rfc2865.ReplyMessage_Lookup(p); err == nil {
+		t.Error("reasons are not sent by default")
+	}
+	if string(rfc2865.ProxyState_Get(p)) != "proxied" {
+		t.Error("proxy state not copied")
+	}
+	// EAP-Response/Identity
+	rfc2869.EAPMessage_Set(req, []byte{2, 42, 0, 9, 1, 'u', 's', 'e', 'r'})
+	ctx.rejectReason = true
+	rej, _ = ctx.localReply(req, nas, denied)
+	if !validResponse(rej, b[4:20], nas.secret) || !validMessageAuthenticator(rej, b[4:20], nas.secret) {
+		t.Error("invalid EAP reject signature")
+	}
+	p, _ = ctx.packet(rej, nas)
+	if !bytes.Equal(rfc2869.EAPMessage_Get(p), []byte{4, 42, 0, 4}) {
+		t.Error("should be an EAP-Failure for the identifier")
+	}
+	if rfc2865.ReplyMessage_GetString(p) != "denied" {
+		t.Error("should send the reason")
+	}
+	accepted := &plugins.Decision{Action: plugins.Accept, Reason: "known", Attributes: make(radius.Attributes)}
+	accepted.Attributes.Add(rfc2865.SessionTimeout_Type, radius.NewInteger(60))
+	acc, _ := ctx.localReply(req, nas, accepted)
+	if radius.Code(acc[0]) != radius.CodeAccessAccept || !validResponse(acc, b[4:20], nas.secret) || !validMessageAuthenticator(acc, b[4:20], nas.secret) {
+		t.Error("invalid accept")
+	}
+	p, _ = ctx.packet(acc, nas)
+	if !bytes.Equal(rfc2869.EAPMessage_Get(p), []byte{3, 42, 0, 4}) {
+		t.Error("should be an EAP-Success for the identifier")
+	}
+	if _, err := rfc2865.ReplyMessage_Lookup(p); err == nil || rfc2865.SessionTimeout_Get(p) != 60 {
+		t.Error("should only have the decision attributes")
+	}
+}
+
+func TestValidRequest(t *testing.T) {
+	p := radius.New(radius.CodeAccountingRequest, []byte("secret"))
+	b, _ := p.Encode()
+	if !validRequest(b, []byte("secret")) {
+		t.Error("should be valid")
+	}
+	if validRequest(b, []byte("other")) || validRequest(nil, []byte("secret")) {
+		t.Error("should be invalid")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/epiphyte/goutils"
 	"layeh.com/radius"
 	. "layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"net"
 	"os"
 	"path/filepath"
 	"plugin"
@@ -18,6 +20,8 @@ const (
 	AccountingMode = "accounting"
 	AuthingMode    = "auth"
 	PreAuthMode    = "preauth"
+	PostAuthMode   = "postauth"
+	RewriteMode    = "rewrite"
 )
 
 type PluginContext struct {
@@ -25,10 +29,57 @@ type PluginContext struct {
 	Logs string
 	// Location of the general lib directory
 	Lib string
-	// Backing config
+	// Backing config (as loaded with the plugin, it is not set up again on reload)
 	Config *goutils.Config
 	// Instance name
 	Instance string
+	// Dynamic authorization (Disconnect/CoA) of accounted sessions
+	DynAuth DynamicAuth
+	// Accounted sessions (linked to their Access-Accept)
+	Sessions SessionTable
+}
+
+// Sends rfc5176 requests to the NAS of the sessions matching a user and/or mac,
+// returns how many sessions were acknowledged
+type DynamicAuth interface {
+	Disconnect(user, mac string) (int, error)
+	Change(user, mac string, attrs radius.Attributes) (int, error)
+}
+
+// Session as tracked from accounting (a copy, it is not updated)
+type Session struct {
+	// Acct-Session-Id
+	ID   string
+	User string
+	// Calling-Station-ID (lowercase hex digits only)
+	MAC   string
+	NASIP net.IP
+	NASID string
+	// NAS-Port (decimal) and NAS-Port-Id, empty when not sent
+	Port   string
+	PortID string
+	// Framed-IP-Address (nil when not sent)
+	FramedIP net.IP
+	Start    time.Time
+	// Octets (including gigawords) as of the last accounting
+	InputBytes  uint64
+	OutputBytes uint64
+	// The Access-Accept preceding the session (zero when none was seen)
+	Authenticated time.Time
+	// Upstream that accepted it (empty when accepted locally)
+	Upstream string
+	// Last accounting
+	Updated time.Time
+}
+
+// Lookups of accounted sessions
+type SessionTable interface {
+	// Sessions of a user
+	User(user string) []Session
+	// Sessions of a mac (any format)
+	MAC(mac string) []Session
+	// Sessions on a port of a NAS (by NAS-IP-Address or NAS-Identifier), the port by NAS-Port or NAS-Port-Id
+	Port(nas, port string) []Session
 }
 
 type Module interface {
@@ -42,16 +93,132 @@ type PreAuth interface {
 	Pre(*radius.Packet) bool
 }
 
+// Version of the Decision (set by plugins, 0 is taken as 1)
+const DecisionVersion = 1
+
+type Action int
+
+const (
+	// Continue (forward upstream unless another plugin decides)
+	Pass Action = iota
+	// Answer with an Access-Accept locally
+	Accept
+	// Answer with an Access-Reject locally
+	Reject
+	// Silently discard the request
+	Drop
+)
+
+func (a Action) String() string {
+	switch a {
+	case Pass:
+		return "pass"
+	case Accept:
+		return "accept"
+	case Reject:
+		return "reject"
+	case Drop:
+		return "drop"
+	}
+	return "unknown"
+}
+
+// Result of a preauth, the most restrictive decision (drop, reject, accept, pass) of all plugins is taken
+type Decision struct {
+	Version int
+	Action  Action
+	// Why (logged and, for rejects, optionally sent as a Reply-Message)
+	Reason string
+	// Added to a local reply (accept or reject)
+	Attributes radius.Attributes
+}
+
+// Preauth with a decision instead of a bool
+type Deciding interface {
+	Module
+	Decide(*radius.Packet) *Decision
+}
+
+type preAuthDecider struct {
+	PreAuth
+}
+
+func (p *preAuthDecider) Decide(packet *radius.Packet) *Decision {
+	if p.Pre(packet) {
+		return &Decision{Version: DecisionVersion, Action: Pass}
+	}
+	return &Decision{Version: DecisionVersion, Action: Reject, Reason: fmt.Sprintf("failed: %s", p.Name())}
+}
+
+// The plugin behind an adapter (for its other interfaces)
+func (p *preAuthDecider) Unwrap() Module {
+	return p.PreAuth
+}
+
+// Get the plugin of a module, unwrapping the PreAuth adapter
+func Unwrap(m Module) Module {
+	if u, ok := m.(interface {
+		Unwrap() Module
+	}); ok {
+		return u.Unwrap()
+	}
+	return m
+}
+
+// Get the decider of a module, a (bool) PreAuth passes or rejects, nil if it does neither
+func AsDeciding(m Module) Deciding {
+	if d, ok := m.(Deciding); ok {
+		return d
+	}
+	if p, ok := m.(PreAuth); ok {
+		return &preAuthDecider{p}
+	}
+	return nil
+}
+
 type Authing interface {
 	Module
 	Auth(*radius.Packet)
 }
 
+// Modifies a request (auth or accounting) before preauth and forwarding,
+// returns true when changed so the request is re-encoded
+type Rewriting interface {
+	Module
+	Rewrite(*radius.Packet) bool
+}
+
+// Modifies an upstream reply (Access-Accept/Reject/Challenge) before it is relayed,
+// returns true when changed so the reply is re-encoded
+type ReplyRewriting interface {
+	Module
+	RewriteReply(request *radius.Packet, reply *radius.Packet) bool
+}
+
+// Receives the original request and the (parsed) upstream reply
+type PostAuth interface {
+	Module
+	Post(*radius.Packet, *radius.Packet)
+}
+
+// Optional, called on shutdown to flush/finish any pending work
+type Stoppable interface {
+	Module
+	Stop()
+}
+
 type Accounting interface {
 	Module
 	Account(*radius.Packet)
 }
 
+// Accounting that reports failure (used instead of Account when implemented),
+// an error (or panic) fails the request for ack_on_success
+type AccountingChecked interface {
+	Accounting
+	AccountChecked(*radius.Packet) error
+}
+
 // Get attributes as Type/Value string arrays
 func KeyValueStrings(packet *radius.Packet) []string {
 	var datum []string
@@ -105,6 +272,30 @@ func KeyValueStrings(packet *radius.Packet) []string {
 	return datum
 }
 
+// Split the realm from a user (user@realm, at the last @, or realm\user, at the first \),
+// the realm is "" (and the user unchanged) unless both sides are set
+func SplitRealm(user string) (string, string) {
+	if idx := strings.LastIndex(user, "@"); idx > 0 && idx < len(user)-1 {
+		return user[idx+1:], user[:idx]
+	}
+	if idx := strings.Index(user, "\\"); idx > 0 && idx < len(user)-1 {
+		return user[:idx], user[idx+1:]
+	}
+	return "", user
+}
+
+// Tunnel-Type of a VLAN (rfc3580)
+const VLANTunnelType rfc2868.TunnelType = 13
+
+// Get the attributes assigning a VLAN (rfc3580: Tunnel-Type, Tunnel-Medium-Type, Tunnel-Private-Group-ID)
+func VLANAttributes(vlan string) radius.Attributes {
+	p := &radius.Packet{Attributes: make(radius.Attributes)}
+	rfc2868.TunnelType_Add(p, 0, VLANTunnelType)
+	rfc2868.TunnelMediumType_Add(p, 0, rfc2868.TunnelMediumType_Value_IEEE802)
+	rfc2868.TunnelPrivateGroupID_AddString(p, 0, vlan)
+	return p.Attributes
+}
+
 func DatedAppendFile(path, name, instance string) (*os.File, time.Time) {
 	return newFile(path, name, instance, true)
 }
@@ -136,6 +327,8 @@ func DisabledModes(m Module, ctx *PluginContext) []string {
 	accounting := ctx.Config.GetTrue(fmt.Sprintf("%s_disable_accounting", name))
 	authing := ctx.Config.GetTrue(fmt.Sprintf("%s_disable_auth", name))
 	preauth := ctx.Config.GetTrue(fmt.Sprintf("%s_disable_preauth", name))
+	postauth := ctx.Config.GetTrue(fmt.Sprintf("%s_disable_postauth", name))
+	rewrite := ctx.Config.GetTrue(fmt.Sprintf("%s_disable_rewrite", name))
 	var modes []string
 	if accounting {
 		modes = append(modes, AccountingMode)
@@ -146,6 +339,12 @@ func DisabledModes(m Module, ctx *PluginContext) []string {
 	if preauth {
 		modes = append(modes, PreAuthMode)
 	}
+	if postauth {
+		modes = append(modes, PostAuthMode)
+	}
+	if rewrite {
+		modes = append(modes, RewriteMode)
+	}
 	return modes
 }
 
@@ -181,18 +380,18 @@ func LoadPlugin(path string, ctx *PluginContext) (Module, error) {
 	if !ok {
 		return nil, errors.New(fmt.Sprintf("unable to load plugin %s", path))
 	}
+	// a (bool) PreAuth is loaded as Deciding, Unwrap gets the plugin
+	if d := AsDeciding(mod); d != nil {
+		mod = d
+	} else {
+		switch mod.(type) {
+		case Accounting, Authing, PostAuth, Rewriting, ReplyRewriting:
+		default:
+			goutils.WriteInfo("plugin has no known hooks", path, fmt.Sprintf("%T", mod))
+		}
+	}
 	mod.Setup(ctx)
 	return mod, nil
-	switch t := mod.(type) {
-	default:
-		return nil, errors.New(fmt.Sprintf("unknown type: %T", t))
-	case Accounting:
-		return t.(Accounting), nil
-	case PreAuth:
-		return t.(PreAuth), nil
-	case Authing:
-		return t.(Authing), nil
-	}
 }
 
 // rfc2865 only, get string names for types
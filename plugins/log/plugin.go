@@ -8,7 +8,8 @@ import (
 )
 
 var (
-	lock     *sync.Mutex = new(sync.Mutex)
+	lock     *sync.Mutex     = new(sync.Mutex)
+	pending  *sync.WaitGroup = new(sync.WaitGroup)
 	logs     string
 	Plugin   logger
 	modes    []string
@@ -31,6 +32,10 @@ func (l *logger) Setup(ctx *plugins.PluginContext) {
 	instance = ctx.Instance
 }
 
+func (l *logger) Stop() {
+	pending.Wait()
+}
+
 func (l *logger) Pre(packet *radius.Packet) bool {
 	write(plugins.PreAuthMode, packet)
 	return true
@@ -40,12 +45,18 @@ func (l *logger) Auth(packet *radius.Packet) {
 	write(plugins.AuthingMode, packet)
 }
 
+func (l *logger) Post(request, reply *radius.Packet) {
+	write(plugins.PostAuthMode, reply)
+}
+
 func (l *logger) Account(packet *radius.Packet) {
 	write(plugins.AccountingMode, packet)
 }
 
 func write(mode string, packet *radius.Packet) {
+	pending.Add(1)
 	go func() {
+		defer pending.Done()
 		lock.Lock()
 		defer lock.Unlock()
 		if plugins.Disabled(mode, modes) {
@@ -55,6 +66,7 @@ func write(mode string, packet *radius.Packet) {
 		if f == nil {
 			return
 		}
+		defer f.Close()
 		attr := plugins.KeyValueStrings(packet)
 		output := fmt.Sprintf("id -> %s \n", mode)
 		plugins.FormatLog(f, t, mode, output)
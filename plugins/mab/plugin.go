@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"github.com/epiphyte/radiucal/plugins"
+	"layeh.com/radius"
+	. "layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type mab struct {
+}
+
+var (
+	Plugin mab
+	modes  []string
+	lock   *sync.RWMutex = new(sync.RWMutex)
+	// known devices (normalized mac) and their VLAN (may be empty)
+	devices map[string]string = make(map[string]string)
+	db      string
+	// VLAN for devices without one (empty for none)
+	vlan string
+	// pass unknown devices upstream instead of rejecting them
+	passUnknown bool
+)
+
+func (m *mab) Name() string {
+	return "mab"
+}
+
+func (m *mab) Setup(ctx *plugins.PluginContext) {
+	modes = plugins.DisabledModes(m, ctx)
+	db = ctx.Config.GetStringOrDefault("mab_db", filepath.Join(ctx.Lib, "mab"))
+	vlan = ctx.Config.GetStringOrDefault("mab_vlan", "")
+	passUnknown = ctx.Config.GetStringOrDefault("mab_unknown", "reject") == "pass"
+	m.Reload()
+}
+
+func (m *mab) Reload() {
+	loaded, err := load(db)
+	if err != nil {
+		goutils.WriteError("unable to load mab database", err)
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	devices = loaded
+}
+
+// read "<mac> [vlan]" lines (# for comments)
+func load(path string) (map[string]string, error) {
+	loaded := make(map[string]string)
+	if goutils.PathNotExists(path) {
+		return loaded, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		mac := clean(parts[0])
+		if len(mac) != 12 || len(parts) > 2 {
+			return nil, errors.New(fmt.Sprintf("invalid mab entry: %s", line))
+		}
+		assigned := ""
+		if len(parts) == 2 {
+			assigned = parts[1]
+		}
+		loaded[mac] = assigned
+	}
+	return loaded, scanner.Err()
+}
+
+// lowercase hex digits only
+func clean(mac string) string {
+	result := ""
+	for _, c := range strings.ToLower(mac) {
+		if (c >= 'a' && c <= 'f') || (c >= '0' && c <= '9') {
+			result = result + string(c)
+		}
+	}
+	return result
+}
+
+func (m *mab) Decide(packet *radius.Packet) *plugins.Decision {
+	pass := &plugins.Decision{Version: plugins.DecisionVersion, Action: plugins.Pass}
+	if plugins.Disabled(plugins.PreAuthMode, modes) {
+		return pass
+	}
+	mac, ok := bypass(packet)
+	if !ok {
+		return pass
+	}
+	lock.RLock()
+	assigned, known := devices[mac]
+	lock.RUnlock()
+	if !known {
+		if passUnknown {
+			return pass
+		}
+		return &plugins.Decision{Version: plugins.DecisionVersion, Action: plugins.Reject, Reason: fmt.Sprintf("unknown device: %s", mac)}
+	}
+	accept := &plugins.Decision{Version: plugins.DecisionVersion, Action: plugins.Accept, Reason: fmt.Sprintf("known device: %s", mac)}
+	if len(assigned) == 0 {
+		assigned = vlan
+	}
+	if len(assigned) > 0 {
+		accept.Attributes = plugins.VLANAttributes(assigned)
+	}
+	return accept
+}
+
+// the (normalized) mac of a MAC Authentication Bypass request:
+// User-Name is the Calling-Station-ID and the PAP/CHAP password is the mac (as sent or normalized)
+func bypass(packet *radius.Packet) (string, bool) {
+	if _, err := rfc2869.EAPMessage_Lookup(packet); err == nil {
+		return "", false
+	}
+	user, err := UserName_LookupString(packet)
+	if err != nil {
+		return "", false
+	}
+	calling, err := CallingStationID_LookupString(packet)
+	if err != nil {
+		return "", false
+	}
+	mac := clean(calling)
+	if len(mac) != 12 || strings.ToLower(strings.Map(dropSeparator, user)) != mac {
+		return "", false
+	}
+	candidates := [][]byte{[]byte(user), []byte(mac)}
+	if password, err := UserPassword_Lookup(packet); err == nil {
+		for _, c := range candidates {
+			if bytes.Equal(password, c) {
+				return mac, true
+			}
+		}
+		return "", false
+	}
+	if chap, err := CHAPPassword_Lookup(packet); err == nil && len(chap) == 17 {
+		challenge, err := CHAPChallenge_Lookup(packet)
+		if err != nil {
+			challenge = packet.Authenticator[:]
+		}
+		for _, c := range candidates {
+			hash := md5.New()
+			hash.Write(chap[0:1])
+			hash.Write(c)
+			hash.Write(challenge)
+			if bytes.Equal(hash.Sum(nil), chap[1:]) {
+				return mac, true
+			}
+		}
+	}
+	return "", false
+}
+
+func dropSeparator(c rune) rune {
+	switch c {
+	case ':', '-', '.':
+		return -1
+	}
+	return c
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/md5"
+	"github.com/epiphyte/radiucal/plugins"
+	"io/ioutil"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/rfc2869"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newRequest(user, calling string) *radius.Packet {
+	p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	rfc2865.UserName_SetString(p, user)
+	rfc2865.CallingStationID_SetString(p, calling)
+	return p
+}
+
+// padded, this version of radius only encrypts whole blocks
+func setPassword(p *radius.Packet, password string) {
+	padded := make([]byte, 16*((len(password)+15)/16))
+	copy(padded, password)
+	rfc2865.UserPassword_Set(p, padded)
+}
+
+func setupDB(t *testing.T, entries string) func() {
+	dir, _ := ioutil.TempDir("", "mab")
+	db = filepath.Join(dir, "mab")
+	ioutil.WriteFile(db, []byte(entries), 0600)
+	vlan = ""
+	passUnknown = false
+	(&mab{}).Reload()
+	return func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	defer setupDB(t, "# devices\n11:22:33:44:55:66 10\n\nAABB.CCDD.EEFF\n")()
+	if len(devices) != 2 || devices["112233445566"] != "10" || devices["aabbccddeeff"] != "" {
+		t.Error("invalid devices", devices)
+	}
+	for _, entries := range []string{"11:22:33 10\n", "112233445566 10 20\n"} {
+		ioutil.WriteFile(db, []byte(entries), 0600)
+		if _, err := load(db); err == nil {
+			t.Error("should be invalid", entries)
+		}
+	}
+	if loaded, err := load(filepath.Join(filepath.Dir(db), "none")); err != nil || len(loaded) != 0 {
+		t.Error("a missing database has no devices")
+	}
+}
+
+func TestBypass(t *testing.T) {
+	p := newRequest("1122.3344.5566", "11:22:33:44:55:66")
+	if _, ok := bypass(p); ok {
+		t.Error("no password")
+	}
+	setPassword(p, "1122.3344.5566")
+	if mac, ok := bypass(p); !ok || mac != "112233445566" {
+		t.Error("should be MAB (pap)")
+	}
+	setPassword(p, "password")
+	if _, ok := bypass(p); ok {
+		t.Error("wrong password")
+	}
+	p = newRequest("112233445566", "11-22-33-44-55-66")
+	hash := md5.New()
+	hash.Write([]byte{7})
+	hash.Write([]byte("112233445566"))
+	hash.Write(p.Authenticator[:])
+	rfc2865.CHAPPassword_Set(p, append([]byte{7}, hash.Sum(nil)...))
+	if _, ok := bypass(p); !ok {
+		t.Error("should be MAB (chap)")
+	}
+	rfc2869.EAPMessage_Set(p, []byte{2, 1, 0, 4})
+	if _, ok := bypass(p); ok {
+		t.Error("EAP is not MAB")
+	}
+	p = newRequest("user", "11-22-33-44-55-66")
+	setPassword(p, "112233445566")
+	if _, ok := bypass(p); ok {
+		t.Error("user is not the mac")
+	}
+}
+
+func TestDecide(t *testing.T) {
+	defer setupDB(t, "11:22:33:44:55:66 10\naa:bb:cc:dd:ee:ff\n")()
+	m := &mab{}
+	p := newRequest("user", "11-22-33-44-55-66")
+	if d := m.Decide(p); d.Action != plugins.Pass {
+		t.Error("not MAB, should pass")
+	}
+	p = newRequest("112233445566", "11-22-33-44-55-66")
+	setPassword(p, "112233445566")
+	d := m.Decide(p)
+	if d.Action != plugins.Accept {
+		t.Error("should accept")
+	}
+	reply := &radius.Packet{Attributes: d.Attributes}
+	if _, group, _ := rfc2868.TunnelPrivateGroupID_LookupString(reply); group != "10" {
+		t.Error("should assign the VLAN")
+	}
+	if _, tunnel, _ := rfc2868.TunnelType_Lookup(reply); tunnel != plugins.VLANTunnelType {
+		t.Error("should be a VLAN tunnel")
+	}
+	p = newRequest("aabbccddeeff", "aa-bb-cc-dd-ee-ff")
+	setPassword(p, "aabbccddeeff")
+	if d := m.Decide(p); d.Action != plugins.Accept || d.Attributes != nil {
+		t.Error("should accept without a VLAN")
+	}
+	vlan = "20"
+	reply = &radius.Packet{Attributes: m.Decide(p).Attributes}
+	if _, group, _ := rfc2868.TunnelPrivateGroupID_LookupString(reply); group != "20" {
+		t.Error("should assign the default VLAN")
+	}
+	p = newRequest("001122334455", "00-11-22-33-44-55")
+	setPassword(p, "001122334455")
+	if d := m.Decide(p); d.Action != plugins.Reject {
+		t.Error("should reject unknown devices")
+	}
+	passUnknown = true
+	if d := m.Decide(p); d.Action != plugins.Pass {
+		t.Error("should pass unknown devices")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/epiphyte/radiucal/plugins"
+	"layeh.com/radius"
+	. "layeh.com/radius/rfc2865"
+	"strings"
+)
+
+type rewriter struct {
+}
+
+var (
+	Plugin rewriter
+	modes  []string
+	// Calling-Station-ID format: colon, dash, bare (or empty to leave as is)
+	macFormat string
+	// strip user@realm and realm\user to user
+	stripRealm bool
+	// NAS-Identifier to add when there is none
+	nasID string
+)
+
+func (r *rewriter) Reload() {
+}
+
+func (r *rewriter) Name() string {
+	return "rewrite"
+}
+
+func (r *rewriter) Setup(ctx *plugins.PluginContext) {
+	modes = plugins.DisabledModes(r, ctx)
+	macFormat = ctx.Config.GetStringOrDefault("rewrite_mac", "")
+	stripRealm = ctx.Config.GetTrue("rewrite_strip_realm")
+	nasID = ctx.Config.GetStringOrDefault("rewrite_nas_id", "")
+}
+
+func (r *rewriter) Rewrite(packet *radius.Packet) bool {
+	if plugins.Disabled(plugins.RewriteMode, modes) {
+		return false
+	}
+	changed := false
+	if calling, err := CallingStationID_LookupString(packet); err == nil {
+		if mac, ok := formatMAC(calling, macFormat); ok && mac != calling {
+			CallingStationID_SetString(packet, mac)
+			changed = true
+		}
+	}
+	if stripRealm {
+		if user, err := UserName_LookupString(packet); err == nil {
+			if stripped := strip(user); stripped != user {
+				UserName_SetString(packet, stripped)
+				changed = true
+			}
+		}
+	}
+	if len(nasID) > 0 {
+		if _, err := NASIdentifier_Lookup(packet); err != nil {
+			NASIdentifier_SetString(packet, nasID)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// format a mac (any separators) as lowercase colon/dash separated or bare hex, false if not a mac
+func formatMAC(mac, format string) (string, bool) {
+	sep := ""
+	switch format {
+	case "colon":
+		sep = ":"
+	case "dash":
+		sep = "-"
+	case "bare":
+	default:
+		return "", false
+	}
+	digits := ""
+	for _, c := range strings.ToLower(mac) {
+		if (c >= 'a' && c <= 'f') || (c >= '0' && c <= '9') {
+			digits = digits + string(c)
+			continue
+		}
+		if c != ':' && c != '-' && c != '.' {
+			return "", false
+		}
+	}
+	if len(digits) != 12 {
+		return "", false
+	}
+	var parts []string
+	for i := 0; i < len(digits); i += 2 {
+		parts = append(parts, digits[i:i+2])
+	}
+	return strings.Join(parts, sep), true
+}
+
+// user without a realm (user@realm or realm\user)
+func strip(user string) string {
+	_, stripped := plugins.SplitRealm(user)
+	return stripped
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"testing"
+)
+
+func TestFormatMAC(t *testing.T) {
+	for _, c := range [][]string{
+		{"11-22-33-44-55-AA", "colon", "11:22:33:44:55:aa"},
+		{"1122.3344.55aa", "dash", "11-22-33-44-55-aa"},
+		{"11:22:33:44:55:aa", "bare", "1122334455aa"},
+	} {
+		if mac, ok := formatMAC(c[0], c[1]); !ok || mac != c[2] {
+			t.Error("invalid format", c, mac)
+		}
+	}
+	for _, c := range []string{"11-22-33-44-55", "not-a-mac", "11 22 33 44 55 66"} {
+		if _, ok := formatMAC(c, "colon"); ok {
+			t.Error("not a mac", c)
+		}
+	}
+	if _, ok := formatMAC("11-22-33-44-55-66", ""); ok {
+		t.Error("no format")
+	}
+}
+
+func TestStrip(t *testing.T) {
+	for _, c := range [][]string{
+		{"user@example.com", "user"},
+		{"EXAMPLE\\user", "user"},
+		{"user", "user"},
+		{"@realm", "@realm"},
+		{"realm\\", "realm\\"},
+		{"user@", "user@"},
+		{"user@sub@example.com", "user@sub"},
+		{"\\user", "\\user"},
+	} {
+		if strip(c[0]) != c[1] {
+			t.Error("invalid strip", c)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	r := &rewriter{}
+	p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	rfc2865.UserName_SetString(p, "user@example.com")
+	rfc2865.CallingStationID_SetString(p, "11-22-33-44-55-AA")
+	macFormat = ""
+	stripRealm = false
+	nasID = ""
+	if r.Rewrite(p) {
+		t.Error("nothing to rewrite")
+	}
+	macFormat = "colon"
+	stripRealm = true
+	nasID = "radiucal"
+	if !r.Rewrite(p) {
+		t.Error("should rewrite")
+	}
+	if rfc2865.UserName_GetString(p) != "user" || rfc2865.CallingStationID_GetString(p) != "11:22:33:44:55:aa" || rfc2865.NASIdentifier_GetString(p) != "radiucal" {
+		t.Error("invalid rewrite")
+	}
+	if r.Rewrite(p) {
+		t.Error("already rewritten")
+	}
+}
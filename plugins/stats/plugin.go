@@ -25,7 +25,8 @@ func (m *modedata) String() string {
 }
 
 var (
-	lock     *sync.Mutex = new(sync.Mutex)
+	lock     *sync.Mutex     = new(sync.Mutex)
+	pending  *sync.WaitGroup = new(sync.WaitGroup)
 	dir      string
 	Plugin   stats
 	info     map[string]*modedata = make(map[string]*modedata)
@@ -52,6 +53,10 @@ func (s *stats) Setup(ctx *plugins.PluginContext) {
 	modes = plugins.DisabledModes(s, ctx)
 }
 
+func (s *stats) Stop() {
+	pending.Wait()
+}
+
 func (s *stats) Pre(packet *radius.Packet) bool {
 	write(plugins.PreAuthMode)
 	return true
@@ -61,12 +66,18 @@ func (s *stats) Auth(packet *radius.Packet) {
 	write(plugins.AuthingMode)
 }
 
+func (s *stats) Post(request, reply *radius.Packet) {
+	write(plugins.PostAuthMode)
+}
+
 func (s *stats) Account(packet *radius.Packet) {
 	write(plugins.AccountingMode)
 }
 
 func write(mode string) {
+	pending.Add(1)
 	go func() {
+		defer pending.Done()
 		lock.Lock()
 		defer lock.Unlock()
 		if plugins.Disabled(mode, modes) {
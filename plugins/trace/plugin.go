@@ -4,14 +4,16 @@ import (
 	"github.com/epiphyte/radiucal/plugins"
 	"layeh.com/radius"
 	"log"
+	"sync"
 )
 
 type tracer struct {
 }
 
 var (
-	Plugin tracer
-	modes  []string
+	Plugin  tracer
+	modes   []string
+	pending *sync.WaitGroup = new(sync.WaitGroup)
 )
 
 func (t *tracer) Reload() {
@@ -25,6 +27,10 @@ func (t *tracer) Setup(ctx *plugins.PluginContext) {
 	modes = plugins.DisabledModes(t, ctx)
 }
 
+func (t *tracer) Stop() {
+	pending.Wait()
+}
+
 func (t *tracer) Pre(packet *radius.Packet) bool {
 	dump(plugins.PreAuthMode, packet)
 	return true
@@ -34,12 +40,18 @@ func (t *tracer) Auth(packet *radius.Packet) {
 	dump(plugins.AuthingMode, packet)
 }
 
+func (t *tracer) Post(request, reply *radius.Packet) {
+	dump(plugins.PostAuthMode, reply)
+}
+
 func (t *tracer) Account(packet *radius.Packet) {
 	dump(plugins.AccountingMode, packet)
 }
 
 func dump(mode string, packet *radius.Packet) {
+	pending.Add(1)
 	go func() {
+		defer pending.Done()
 		if plugins.Disabled(mode, modes) {
 			return
 		}
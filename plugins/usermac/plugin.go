@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"github.com/epiphyte/goutils"
 	"github.com/epiphyte/radiucal/plugins"
 	"layeh.com/radius"
 	. "layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -23,23 +26,29 @@ var (
 	cache    map[string]bool = make(map[string]bool)
 	lock     *sync.Mutex     = new(sync.Mutex)
 	fileLock *sync.Mutex     = new(sync.Mutex)
+	pending  *sync.WaitGroup = new(sync.WaitGroup)
 	canCache bool
 	db       string
 	logs     string
 	Plugin   umac
 	instance string
+	modes    []string
 	// Function callback on failed/passed
 	doCallback bool
 	callback   []string
+	// VLAN of a user+mac ("vlan=<id>" in its users file, empty for none)
+	vlans map[string]string = make(map[string]string)
 )
 
 func (l *umac) Reload() {
 	lock.Lock()
 	defer lock.Unlock()
 	cache = make(map[string]bool)
+	vlans = make(map[string]string)
 }
 
 func (l *umac) Setup(ctx *plugins.PluginContext) {
+	modes = plugins.DisabledModes(l, ctx)
 	canCache = ctx.Config.GetTrue("cache")
 	logs = ctx.Logs
 	instance = ctx.Instance
@@ -48,6 +57,10 @@ func (l *umac) Setup(ctx *plugins.PluginContext) {
 	doCallback = len(callback) > 0
 }
 
+func (l *umac) Stop() {
+	pending.Wait()
+}
+
 func (l *umac) Pre(packet *radius.Packet) bool {
 	return checkUserMac(packet) == nil
 }
@@ -62,18 +75,26 @@ func clean(in string) string {
 	return result
 }
 
-func checkUserMac(p *radius.Packet) error {
+// the users file name (<user>.<mac>, cleaned) of a request with its user and mac
+func userMac(p *radius.Packet) (string, string, string, error) {
 	username, err := UserName_LookupString(p)
 	if err != nil {
-		return err
+		return "", "", "", err
 	}
 	calling, err := CallingStationID_LookupString(p)
 	if err != nil {
-		return err
+		return "", "", "", err
 	}
 	username = clean(username)
 	calling = clean(calling)
-	fqdn := fmt.Sprintf("%s.%s", username, calling)
+	return fmt.Sprintf("%s.%s", username, calling), username, calling, nil
+}
+
+func checkUserMac(p *radius.Packet) error {
+	fqdn, username, calling, err := userMac(p)
+	if err != nil {
+		return err
+	}
 	lock.Lock()
 	good, ok := cache[fqdn]
 	lock.Unlock()
@@ -98,11 +119,18 @@ func checkUserMac(p *radius.Packet) error {
 		failure = errors.New(fmt.Sprintf("failed preauth: %s %s", username, calling))
 		result = "failed"
 	}
-	go mark(result, username, calling, p)
+	// settings are passed so the mark does not read them while they change
+	var run []string
+	if doCallback {
+		run = callback
+	}
+	pending.Add(1)
+	go mark(result, username, calling, p, logs, instance, run)
 	return failure
 }
 
-func mark(result, user, calling string, p *radius.Packet) {
+func mark(result, user, calling string, p *radius.Packet, logs, instance string, callback []string) {
+	defer pending.Done()
 	nas := clean(NASIdentifier_GetString(p))
 	if len(nas) == 0 {
 		nas = "unknown"
@@ -121,7 +149,7 @@ func mark(result, user, calling string, p *radius.Packet) {
 	}
 	defer f.Close()
 	msg := fmt.Sprintf("%s (mac:%s) (nas:%s,ip:%s,port:%d)", user, calling, nas, nasip, nasport)
-	if doCallback {
+	if len(callback) > 0 {
 		goutils.WriteDebug("perform callback", callback...)
 		args := callback[1:]
 		args = append(args, fmt.Sprintf("%s -> %s", result, msg))
@@ -129,3 +157,73 @@ func mark(result, user, calling string, p *radius.Packet) {
 	}
 	plugins.FormatLog(f, t, result, msg)
 }
+
+// assign the VLAN of the user+mac (if any) to an Access-Accept
+func (l *umac) RewriteReply(request *radius.Packet, reply *radius.Packet) bool {
+	if reply.Code != radius.CodeAccessAccept || plugins.Disabled(plugins.RewriteMode, modes) {
+		return false
+	}
+	fqdn, _, _, err := userMac(request)
+	if err != nil {
+		return false
+	}
+	vlan := getVLAN(fqdn)
+	if len(vlan) == 0 {
+		return false
+	}
+	goutils.WriteDebug("assigning vlan", fqdn, vlan)
+	// replaces any assignment made upstream
+	reply.Del(rfc2868.TunnelType_Type)
+	reply.Del(rfc2868.TunnelMediumType_Type)
+	reply.Del(rfc2868.TunnelPrivateGroupID_Type)
+	for t, values := range plugins.VLANAttributes(vlan) {
+		for _, v := range values {
+			reply.Add(t, v)
+		}
+	}
+	return true
+}
+
+func getVLAN(fqdn string) string {
+	lock.Lock()
+	vlan, ok := vlans[fqdn]
+	lock.Unlock()
+	if canCache && ok {
+		return vlan
+	}
+	vlan, err := readVLAN(filepath.Join(db, fqdn))
+	if err != nil {
+		goutils.WriteError(fmt.Sprintf("unable to read vlan: %s", fqdn), err)
+		return ""
+	}
+	lock.Lock()
+	vlans[fqdn] = vlan
+	lock.Unlock()
+	return vlan
+}
+
+// read the "vlan=<id>" line of a users file (# for comments), empty for none
+func readVLAN(path string) (string, error) {
+	if goutils.PathNotExists(path) {
+		return "", nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	vlan := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "vlan" || len(strings.TrimSpace(parts[1])) == 0 {
+			return "", errors.New(fmt.Sprintf("invalid users entry: %s", line))
+		}
+		vlan = strings.TrimSpace(parts[1])
+	}
+	return vlan, scanner.Err()
+}
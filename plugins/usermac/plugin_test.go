@@ -1,8 +1,10 @@
 package main
 
 import (
+	"github.com/epiphyte/radiucal/plugins"
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
 	"testing"
 )
 
@@ -81,3 +83,39 @@ func TestUserMacCallback(t *testing.T) {
 		t.Error("should have authed")
 	}
 }
+
+func TestUserMacVLAN(t *testing.T) {
+	m := setupUserMac()
+	modes = []string{}
+	for user, vlan := range map[string]string{"test": "", "vlan": "20", "invalid": "", "unknown": ""} {
+		request := radius.New(radius.CodeAccessRequest, []byte("secret"))
+		rfc2865.UserName_AddString(request, user)
+		rfc2865.CallingStationID_AddString(request, "11-22-33-44-55-66")
+		reply := request.Response(radius.CodeAccessAccept)
+		rfc2868.TunnelPrivateGroupID_AddString(reply, 0, "10")
+		if m.RewriteReply(request, reply) != (len(vlan) > 0) {
+			t.Error("invalid rewrite", user)
+		}
+		_, assigned := rfc2868.TunnelPrivateGroupID_GetString(reply)
+		if len(vlan) > 0 && (assigned != vlan || len(reply.Attributes[rfc2868.TunnelPrivateGroupID_Type]) != 1) {
+			t.Error("should assign the vlan", user, assigned)
+		}
+		if len(vlan) == 0 && assigned != "10" {
+			t.Error("should keep the upstream vlan", user, assigned)
+		}
+		if _, tunnel, _ := rfc2868.TunnelType_Lookup(reply); len(vlan) > 0 && tunnel != plugins.VLANTunnelType {
+			t.Error("should be a vlan tunnel", user)
+		}
+	}
+	request := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	rfc2865.UserName_AddString(request, "vlan")
+	rfc2865.CallingStationID_AddString(request, "11-22-33-44-55-66")
+	if m.RewriteReply(request, request.Response(radius.CodeAccessReject)) {
+		t.Error("only accepts are assigned a vlan")
+	}
+	modes = []string{plugins.RewriteMode}
+	if m.RewriteReply(request, request.Response(radius.CodeAccessAccept)) {
+		t.Error("rewrite is disabled")
+	}
+	modes = []string{}
+}
@@ -3,30 +3,74 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/epiphyte/goutils"
 	"github.com/epiphyte/radiucal/plugins"
+	"io"
 	"layeh.com/radius"
 	"net"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var vers = "master"
 
 var (
-	proxy         *net.UDPConn
-	serverAddress *net.UDPAddr
-	clients       map[string]*connection = make(map[string]*connection)
-	clientLock    *sync.Mutex            = new(sync.Mutex)
+	proxy       *net.UDPConn
+	clients     map[string]*connection = make(map[string]*connection)
+	clientLock  *sync.Mutex            = new(sync.Mutex)
+	idleTimeout time.Duration          = 5 * time.Minute
+	maxClients  int
 )
 
 type connection struct {
-	client *net.UDPAddr
+	client net.Addr
+	nas    *client
 	server *net.UDPConn
+	// last time the client sent us a packet (guarded by clientLock)
+	last time.Time
+	done chan bool
+	// requests (by code class and identifier) waiting on an upstream reply
+	pending map[pendingKey]*request
+	// streams to tcp upstreams (guarded by lock)
+	streams map[*upstream]net.Conn
+	lock    *sync.Mutex
+}
+
+// auth and accounting requests from a NAS port each have their own identifiers
+type pendingKey struct {
+	accounting bool
+	identifier byte
+}
+
+// key a request (or its reply) by code class and identifier
+func pendingFor(buffer []byte) pendingKey {
+	code := radius.Code(buffer[0])
+	accounting := code == radius.CodeAccountingRequest || code == radius.CodeAccountingResponse
+	return pendingKey{accounting: accounting, identifier: buffer[1]}
+}
+
+// request forwarded upstream
+type request struct {
+	// the request as received from the NAS (if parsed)
+	parsed *radius.Packet
+	// duplicate detection key
+	key string
+	// authenticator as sent by the NAS
+	authenticator []byte
+	// authenticator as sent upstream
+	forwarded []byte
+	server    *upstream
+	sent      time.Time
+	// replies to the client (auth and accounting may arrive on different sockets)
+	send func([]byte) error
 }
 
 func logError(message string, err error) bool {
@@ -37,48 +81,453 @@ func logError(message string, err error) bool {
 	return true
 }
 
-func newConnection(srv, cli *net.UDPAddr) *connection {
+func newConnection(cli net.Addr, nas *client) *connection {
 	conn := new(connection)
 	conn.client = cli
-	srvudp, err := net.DialUDP("udp", nil, srv)
-	if logError("dial udp", err) {
+	conn.nas = nas
+	// not connected, requests may go to any of the upstreams
+	srvudp, err := net.ListenUDP("udp", nil)
+	if logError("listen udp", err) {
 		return nil
 	}
 	conn.server = srvudp
+	conn.last = time.Now()
+	conn.done = make(chan bool)
+	conn.pending = make(map[pendingKey]*request)
+	conn.streams = make(map[*upstream]net.Conn)
+	conn.lock = new(sync.Mutex)
 	return conn
 }
 
-func setup(hostport string, port int) error {
-	saddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
-	if err != nil {
+// translate and forward a request to an upstream, the key is that of the request as received (for duplicates)
+func (conn *connection) forward(key string, buffer []byte, p *radius.Packet, server *upstream, send func([]byte) error) error {
+	req := &request{key: key, authenticator: make([]byte, authenticatorLength), server: server, sent: time.Now(), parsed: p, send: send}
+	if p != nil {
+		// as sent by the NAS (a rewritten accounting request has a new authenticator)
+		copy(req.authenticator, p.Authenticator[:])
+	} else {
+		copy(req.authenticator, buffer[4:20])
+	}
+	translate(buffer, req.authenticator, conn.nas.secret, server.secret)
+	req.forwarded = make([]byte, authenticatorLength)
+	copy(req.forwarded, buffer[4:20])
+	conn.lock.Lock()
+	conn.pending[pendingFor(buffer)] = req
+	conn.lock.Unlock()
+	if server.tcp {
+		stream, err := conn.stream(server)
+		if err != nil {
+			return err
+		}
+		_, err = stream.Write(buffer)
 		return err
 	}
-	pudp, err := net.ListenUDP("udp", saddr)
+	_, err := conn.server.WriteToUDP(buffer, server.addr)
+	return err
+}
+
+// get (or dial) the stream to a tcp upstream, replies are read until it closes
+func (conn *connection) stream(server *upstream) (net.Conn, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if stream, ok := conn.streams[server]; ok {
+		return stream, nil
+	}
+	if conn.closed() {
+		return nil, errors.New("connection closed")
+	}
+	stream, err := net.DialTimeout("tcp", server.addr.String(), healthTimeout)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	proxy = pudp
-	srvaddr, err := net.ResolveUDPAddr("udp", hostport)
+	conn.streams[server] = stream
+	go conn.readStream(server, stream)
+	return stream, nil
+}
+
+func (conn *connection) readStream(server *upstream, stream net.Conn) {
+	defer func() {
+		conn.lock.Lock()
+		if conn.streams[server] == stream {
+			delete(conn.streams, server)
+		}
+		conn.lock.Unlock()
+		stream.Close()
+	}()
+	var buffer [radius.MaxPacketLength]byte
+	for {
+		stream.SetReadDeadline(time.Now().Add(idleTimeout))
+		n, err := readPacket(stream, buffer[0:])
+		if err != nil {
+			if !conn.closed() && err != io.EOF {
+				goutils.WriteDebug("closing upstream stream", server.name, err.Error())
+			}
+			return
+		}
+		conn.relay(buffer[0:n], server.addr)
+	}
+}
+
+// get (and clear) the request an upstream reply is for
+func (conn *connection) reply(buffer []byte, from *net.UDPAddr) *request {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	key := pendingFor(buffer)
+	req, ok := conn.pending[key]
+	if !ok || !req.server.is(from) {
+		return nil
+	}
+	delete(conn.pending, key)
+	return req
+}
+
+// close the upstream sockets, this will also stop the runConnection routine
+func (conn *connection) close() {
+	close(conn.done)
+	conn.server.Close()
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	for _, stream := range conn.streams {
+		stream.Close()
+	}
+}
+
+func (conn *connection) closed() bool {
+	select {
+	case <-conn.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func clientKey(cliaddr net.Addr) string {
+	return fmt.Sprintf("%s/%s", cliaddr.Network(), cliaddr.String())
+}
+
+// get (or create) the connection for a client
+func getConnection(cliaddr net.Addr, nas *client) *connection {
+	saddr := clientKey(cliaddr)
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	conn, found := clients[saddr]
+	if found {
+		conn.last = time.Now()
+		return conn
+	}
+	if maxClients > 0 && len(clients) >= maxClients {
+		evictOldest()
+	}
+	conn = newConnection(cliaddr, nas)
+	if conn == nil {
+		return nil
+	}
+	clients[saddr] = conn
+	go runConnection(conn)
+	return conn
+}
+
+// drop the least recently used client (clientLock must be held)
+func evictOldest() {
+	var oldest string
+	var conn *connection
+	for k, c := range clients {
+		if conn == nil || c.last.Before(conn.last) {
+			oldest = k
+			conn = c
+		}
+	}
+	if conn == nil {
+		return
+	}
+	goutils.WriteDebug("client limit reached, evicting", oldest)
+	delete(clients, oldest)
+	conn.close()
+}
+
+// drop any clients that have not sent anything within the idle timeout
+func evictIdle(now time.Time) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	for k, c := range clients {
+		if now.Sub(c.last) < idleTimeout {
+			continue
+		}
+		goutils.WriteDebug("client is idle, evicting", k)
+		delete(clients, k)
+		c.close()
+	}
+}
+
+// drop a client (e.g. when its stream is closed)
+func dropConnection(cliaddr net.Addr) {
+	saddr := clientKey(cliaddr)
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if conn, ok := clients[saddr]; ok {
+		delete(clients, saddr)
+		conn.close()
+	}
+}
+
+func closeClients() {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	for _, c := range clients {
+		c.close()
+	}
+	clients = make(map[string]*connection)
+}
+
+func expireClients() {
+	interval := idleTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		evictIdle(now)
+		evictStates(now)
+		evictSessions(now)
+	}
+}
+
+func setup(port int) error {
+	pudp, err := listenUDP(port)
 	if err != nil {
 		return err
 	}
-	serverAddress = srvaddr
+	proxy = pudp
 	return nil
 }
 
+func listenUDP(port int) (*net.UDPConn, error) {
+	saddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", saddr)
+}
+
 func runConnection(conn *connection) {
 	var buffer [radius.MaxPacketLength]byte
 	for {
-		n, err := conn.server.Read(buffer[0:])
-		if logError("unable to read", err) {
+		n, srvaddr, err := conn.server.ReadFromUDP(buffer[0:])
+		if err != nil {
+			if conn.closed() {
+				return
+			}
+			logError("unable to read", err)
 			continue
 		}
-		_, err = proxy.WriteToUDP(buffer[0:n], conn.client)
-		logError("relaying", err)
+		conn.relay(buffer[0:n], srvaddr)
+	}
+}
+
+// relay an upstream reply back to the client
+func (conn *connection) relay(buffered []byte, srvaddr *net.UDPAddr) {
+	if len(buffered) < 20 {
+		return
+	}
+	req := conn.reply(buffered, srvaddr)
+	if req == nil {
+		goutils.WriteDebug("unexpected reply from upstream", srvaddr.String())
+		return
+	}
+	server := req.server
+	if !validResponse(buffered, req.forwarded, server.secret) {
+		goutils.WriteDebug("invalid reply authenticator from upstream", server.name)
+		return
+	}
+	translate(buffered, req.authenticator, server.secret, conn.nas.secret)
+	if !bytes.Equal(req.forwarded, req.authenticator) {
+		// the request was re-encoded (rewritten), the reply is for the request as sent by the NAS
+		signPacket(buffered, conn.nas.secret, req.authenticator)
+	}
+	ctx := currentContext()
+	resp, b, err := ctx.rewriteReply(req.parsed, buffered, conn.nas, req.authenticator)
+	if !logError("unable to rewrite reply", err) && b != nil {
+		buffered = b
+	}
+	cacheReply(req.key, buffered)
+	logError("relaying", req.send(buffered))
+	if resp == nil {
+		return
+	}
+	pinState(resp, server)
+	trackAccept(req.parsed, resp, clientIP(conn.client), server.name, time.Now())
+	ctx.postAuthPacket(req.parsed, resp)
+}
+
+// check for (and answer) a duplicate request
+func duplicated(key string, send func([]byte) error) bool {
+	reply, ok := checkDuplicate(key, time.Now())
+	if ok && reply != nil {
+		logError("duplicate reply", send(reply))
+	}
+	return ok
+}
+
+// send replies to a udp client (from the socket the request arrived on)
+func udpSender(socket *net.UDPConn, cliaddr *net.UDPAddr) func([]byte) error {
+	return func(b []byte) error {
+		if replies != nil {
+			queueReply(socket, b, cliaddr)
+			return nil
+		}
+		_, err := socket.WriteToUDP(b, cliaddr)
+		return err
+	}
+}
+
+// preauth a request and forward it upstream (or answer it locally)
+func authenticate(ctx *context, buffered []byte, cliaddr net.Addr, nas *client, send func([]byte) error) {
+	key := requestKey(cliaddr, buffered)
+	if duplicated(key, send) {
+		return
+	}
+	// parsed once for all plugins, we may not be able to always read a packet
+	// during conversation (especially during initial EAP phases), we let that go
+	p, err := ctx.packet(buffered, nas)
+	if err != nil {
+		p = nil
+		if ctx.debug {
+			goutils.WriteError("unable to parse packets", err)
+		}
+	}
+	if rateLimited(p, clientIP(cliaddr), time.Now()) {
+		if rateReject {
+			answer(ctx, key, p, nas, &plugins.Decision{Action: plugins.Reject, Reason: "rate limited"}, send)
+		} else {
+			forgetDuplicate(key)
+		}
+		return
+	}
+	if buffered, err = rewritten(ctx, buffered, p, nas); err != nil {
+		forgetDuplicate(key)
+		return
+	}
+	switch d := ctx.decide(p); d.Action {
+	case plugins.Drop:
+		forgetDuplicate(key)
+		return
+	case plugins.Reject:
+		if ctx.noreject {
+			forgetDuplicate(key)
+		} else {
+			answer(ctx, key, p, nas, d, send)
+		}
+		return
+	case plugins.Accept:
+		if resp := answer(ctx, key, p, nas, d, send); resp != nil {
+			trackAccept(p, resp, clientIP(cliaddr), "", time.Now())
+			ctx.postAuthPacket(p, resp)
+		}
+		return
+	}
+	// only requests going upstream need a connection
+	conn := getConnection(cliaddr, nas)
+	if conn == nil {
+		forgetDuplicate(key)
+		return
+	}
+	servers, buffered, err := route(ctx, buffered, p, nas)
+	if logError("unable to route", err) {
+		forgetDuplicate(key)
+		return
+	}
+	err = conn.forward(key, buffered, p, selectUpstream(servers, p), send)
+	if logError("server write", err) {
+		forgetDuplicate(key)
 	}
 }
 
-func runProxy(ctx *context) {
+// the request as rewritten by plugins (or as received), requests that can not be re-encoded are dropped
+func rewritten(ctx *context, buffered []byte, p *radius.Packet, nas *client) ([]byte, error) {
+	b, err := ctx.rewriteRequest(p, nas)
+	if logError("unable to rewrite request", err) {
+		return nil, err
+	}
+	if b == nil {
+		return buffered, nil
+	}
+	return b, nil
+}
+
+// answer a request locally (accept or reject), the reply is returned (parsed)
+func answer(ctx *context, key string, p *radius.Packet, nas *client, d *plugins.Decision, send func([]byte) error) *radius.Packet {
+	if p == nil {
+		forgetDuplicate(key)
+		return nil
+	}
+	b, err := ctx.localReply(p, nas, d)
+	if err != nil {
+		if ctx.debug {
+			goutils.WriteError("unable to encode reply", err)
+		}
+		forgetDuplicate(key)
+		return nil
+	}
+	cacheReply(key, b)
+	send(b)
+	resp, err := ctx.packet(b, nas)
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// account a request and acknowledge it (or forward it upstream)
+func accountRequest(ctx *context, buffered []byte, cliaddr net.Addr, nas *client, send func([]byte) error) {
+	key := requestKey(cliaddr, buffered)
+	if duplicated(key, send) {
+		return
+	}
+	accounting := len(buffered) >= 20 && radius.Code(buffered[0]) == radius.CodeAccountingRequest
+	if accounting && !validRequest(buffered, nas.secret) {
+		goutils.WriteDebug("invalid accounting request authenticator", cliaddr.String())
+		forgetDuplicate(key)
+		return
+	}
+	p, err := ctx.packet(buffered, nas)
+	if err != nil {
+		// unable to parse, nothing to account or acknowledge
+		forgetDuplicate(key)
+		return
+	}
+	if buffered, err = rewritten(ctx, buffered, p, nas); err != nil {
+		forgetDuplicate(key)
+		return
+	}
+	trackSession(p, nas, clientIP(cliaddr), time.Now())
+	success := ctx.accountPacket(p)
+	if !accounting || (ctx.ackSuccess && !success) {
+		forgetDuplicate(key)
+		return
+	}
+	if forwarding := getPool(accountingPool); forwarding != nil {
+		// the upstream will acknowledge
+		conn := getConnection(cliaddr, nas)
+		if conn == nil {
+			forgetDuplicate(key)
+			return
+		}
+		err := conn.forward(key, buffered, p, selectUpstream(forwarding, nil), send)
+		if logError("accounting forward", err) {
+			forgetDuplicate(key)
+		}
+		return
+	}
+	resp, err := ctx.acknowledgePacket(p)
+	if logError("unable to create accounting response", err) {
+		forgetDuplicate(key)
+		return
+	}
+	cacheReply(key, resp)
+	logError("accounting response", send(resp))
+}
+
+func runProxy(socket *net.UDPConn) {
+	ctx := currentContext()
 	if ctx.debug {
 		goutils.WriteInfo("=============WARNING==================")
 		goutils.WriteInfo("debugging is enabled!")
@@ -87,63 +536,31 @@ func runProxy(ctx *context) {
 		goutils.WriteInfo("=============WARNING==================")
 		goutils.WriteDebug("secret", string(ctx.secret))
 	}
-	var buffer [radius.MaxPacketLength]byte
-	for {
-		n, cliaddr, err := proxy.ReadFromUDP(buffer[0:])
-		if logError("read from udp", err) {
-			continue
-		}
-		saddr := cliaddr.String()
-		clientLock.Lock()
-		conn, found := clients[saddr]
-		if !found {
-			conn = newConnection(serverAddress, cliaddr)
-			if conn == nil {
-				clientLock.Unlock()
-				continue
-			}
-			clients[saddr] = conn
-			clientLock.Unlock()
-			go runConnection(conn)
-		} else {
-			clientLock.Unlock()
-		}
-		buffered := []byte(buffer[0:n])
-		if !ctx.authorize(buffered) {
-			if !ctx.noreject {
-				p, err := radius.Parse(buffered, []byte(ctx.secret))
-				if err == nil {
-					p = p.Response(radius.CodeAccessReject)
-					rej, err := p.Encode()
-					if err == nil {
-						proxy.WriteToUDP(rej, conn.client)
-					} else {
-						if ctx.debug {
-							goutils.WriteError("unable to encode rejection", err)
-						}
-					}
-				} else {
-					if ctx.debug {
-						goutils.WriteError("unable to parse packets", err)
-					}
-				}
-			}
-			continue
-		}
-		_, err = conn.server.Write(buffer[0:n])
-		logError("server write", err)
-	}
+	serveUDP(socket, authenticate)
 }
 
-func account(ctx *context) {
-	var buffer [radius.MaxPacketLength]byte
-	for {
-		n, _, err := proxy.ReadFromUDP(buffer[0:])
-		if logError("accounting udp error", err) {
-			continue
+func account(socket *net.UDPConn) {
+	serveUDP(socket, accountRequest)
+}
+
+// read requests from known clients and dispatch them to a handler (until the socket closes)
+func serveUDP(socket *net.UDPConn, handler func(*context, []byte, net.Addr, *client, func([]byte) error)) {
+	readPackets(socket, func(b *[radius.MaxPacketLength]byte, n int, cliaddr *net.UDPAddr) {
+		ctx := currentContext()
+		nas := ctx.clients.lookup(cliaddr.IP)
+		if nas == nil {
+			goutils.WriteInfo("dropping packet from unknown client", cliaddr.String())
+			putBuffer(b)
+			return
 		}
-		ctx.account(buffer[0:n])
-	}
+		ok := dispatch(clientKey(cliaddr), func() {
+			handler(ctx, b[0:n], cliaddr, nas, udpSender(socket, cliaddr))
+			putBuffer(b)
+		})
+		if !ok {
+			putBuffer(b)
+		}
+	})
 }
 
 func main() {
@@ -151,92 +568,280 @@ func main() {
 	var config = flag.String("config", "/etc/radiucal/radiucal.conf", "Configuration file")
 	var instance = flag.String("instance", "", "Instance name")
 	var debugging = flag.Bool("debug", false, "debugging")
+	var cmd = flag.String("command", "", fmt.Sprintf("Send a command to the running instance (%s)", controlUsage))
 	flag.Parse()
 	conf, err := goutils.LoadConfig(*config, goutils.NewConfigSettings())
 	if err != nil {
 		goutils.WriteError("unable to load config", err)
 		panic("invalid/unable to load config")
 	}
-	debug := conf.GetTrue("debug") || *debugging
-	logOpts := goutils.NewLogOptions()
-	logOpts.Debug = debug
-	logOpts.Info = true
-	logOpts.Instance = *instance
-	goutils.ConfigureLogging(logOpts)
-	host := conf.GetStringOrDefault("host", "localhost")
-	var to int = 1814
+	control := conf.GetStringOrDefault("control", "")
+	if len(*cmd) > 0 {
+		if len(control) == 0 {
+			panic("no control socket configured")
+		}
+		result, err := sendCommand(control, *cmd)
+		if logError("unable to send command", err) {
+			os.Exit(1)
+		}
+		fmt.Println(result)
+		if strings.HasPrefix(result, "error") {
+			os.Exit(1)
+		}
+		return
+	}
+	configureLogging(conf.GetTrue("debug") || *debugging, *instance)
 	accounting := conf.GetTrue("accounting")
 	defaultBind := 1812
 	if accounting {
 		defaultBind = 1813
-	} else {
-		to, err = conf.GetIntOrDefault("to", 1814)
-		if err != nil {
-			goutils.WriteError("unable to get bind-to", err)
-			panic("cannot bind to another socket")
-		}
 	}
 	bind, err := conf.GetIntOrDefault("bind", defaultBind)
 	if err != nil {
 		goutils.WriteError("unable to bind address", err)
 		panic("unable to bind")
 	}
-	addr := fmt.Sprintf("%s:%d", host, to)
-	err = setup(addr, bind)
+	idle, err := conf.GetIntOrDefault("idle_timeout", 300)
+	if err != nil {
+		goutils.WriteError("invalid idle timeout", err)
+		panic("invalid idle timeout")
+	}
+	if idle > 0 {
+		idleTimeout = time.Duration(idle) * time.Second
+	}
+	maxClients, err = conf.GetIntOrDefault("max_clients", 0)
+	if err != nil {
+		goutils.WriteError("invalid max clients", err)
+		panic("invalid max clients")
+	}
+	health, err := conf.GetIntOrDefault("health_interval", 0)
+	if err != nil {
+		goutils.WriteError("invalid health interval", err)
+		panic("invalid health interval")
+	}
+	healthInterval = time.Duration(health) * time.Second
+	healthFailures, err = conf.GetIntOrDefault("health_failures", 3)
+	if err != nil {
+		goutils.WriteError("invalid health failures", err)
+		panic("invalid health failures")
+	}
+	window, err := conf.GetIntOrDefault("duplicate_window", 10)
+	if err != nil {
+		goutils.WriteError("invalid duplicate window", err)
+		panic("invalid duplicate window")
+	}
+	dupWindow = time.Duration(window) * time.Second
+	ctx, servers, err := loadContext(conf, *instance, *debugging, accounting)
+	if logError("unable to load", err) {
+		panic("unable to proceed")
+	}
+	setPools(servers)
+	setContext(ctx)
+	err = setup(bind)
 	if logError("proxy setup", err) {
 		panic("unable to proceed")
 	}
-
-	lib := conf.GetStringOrDefault("dir", "/var/lib/radiucal/")
-	secrets := filepath.Join(lib, "secrets")
-	secret := parseSecrets(secrets)
-	ctx := &context{debug: debug, secret: []byte(secret), noreject: conf.GetTrue("noreject")}
-	mods := conf.GetArrayOrEmpty("plugins")
-	pCtx := &plugins.PluginContext{}
-	pCtx.Logs = filepath.Join(lib, "log")
-	pCtx.Lib = lib
-	pCtx.Config = conf
-	pCtx.Instance = *instance
-	pPath := filepath.Join(lib, "plugins")
-	for _, p := range mods {
-		oPath := filepath.Join(pPath, fmt.Sprintf("%s.rd", p))
-		goutils.WriteInfo("loading plugin", p, oPath)
-		obj, err := plugins.LoadPlugin(oPath, pCtx)
+	var radsec net.Listener
+	if conf.GetTrue("radsec") {
+		radsecPort, err := conf.GetIntOrDefault("radsec_bind", 2083)
 		if err != nil {
-			goutils.WriteError(fmt.Sprintf("unable to load plugin: %s", p), err)
-			panic("unable to load plugin")
+			goutils.WriteError("invalid radsec bind", err)
+			panic("unable to bind radsec")
 		}
-		if i, ok := obj.(plugins.Accounting); ok {
-			ctx.acct = true
-			ctx.accts = append(ctx.accts, i)
+		certs := "/etc/hostapd/certs/"
+		tlsConfig, err := radsecConfig(conf.GetStringOrDefault("radsec_cert", certs+"server.pem"),
+			conf.GetStringOrDefault("radsec_key", certs+"server.key"),
+			conf.GetStringOrDefault("radsec_key_password", ""),
+			conf.GetStringOrDefault("radsec_ca", certs+"ca.pem"))
+		if logError("radsec setup", err) {
+			panic("unable to setup radsec")
 		}
-		if i, ok := obj.(plugins.Authing); ok {
-			ctx.auth = true
-			ctx.auths = append(ctx.auths, i)
+		radsec, err = listenRadSec(radsecPort, tlsConfig)
+		if logError("radsec listen", err) {
+			panic("unable to bind radsec")
 		}
-		if i, ok := obj.(plugins.PreAuth); ok {
-			ctx.preauth = true
-			ctx.preauths = append(ctx.preauths, i)
+	}
+	macRate, err := conf.GetIntOrDefault("mac_rate", 0)
+	if err != nil {
+		goutils.WriteError("invalid mac rate", err)
+		panic("invalid mac rate")
+	}
+	macBurst, err := conf.GetIntOrDefault("mac_burst", 0)
+	if err != nil {
+		goutils.WriteError("invalid mac burst", err)
+		panic("invalid mac burst")
+	}
+	nasRate, err := conf.GetIntOrDefault("nas_rate", 0)
+	if err != nil {
+		goutils.WriteError("invalid nas rate", err)
+		panic("invalid nas rate")
+	}
+	nasBurst, err := conf.GetIntOrDefault("nas_burst", 0)
+	if err != nil {
+		goutils.WriteError("invalid nas burst", err)
+		panic("invalid nas burst")
+	}
+	macLimit = newLimiter("mac", macRate, macBurst)
+	nasLimit = newLimiter("nas", nasRate, nasBurst)
+	switch conf.GetStringOrDefault("rate_action", "drop") {
+	case "drop":
+	case "reject":
+		rateReject = true
+	default:
+		panic("invalid rate action (drop or reject)")
+	}
+	workers, err := conf.GetIntOrDefault("workers", 8)
+	if err != nil {
+		goutils.WriteError("invalid workers", err)
+		panic("invalid workers")
+	}
+	depth, err := conf.GetIntOrDefault("queue_depth", 100)
+	if err != nil || depth <= 0 {
+		goutils.WriteError("invalid queue depth", err)
+		panic("invalid queue depth")
+	}
+	batchSize, err = conf.GetIntOrDefault("udp_batch", 0)
+	if err != nil || batchSize < 0 {
+		goutils.WriteError("invalid udp batch", err)
+		panic("invalid udp batch")
+	}
+	wait, err := conf.GetIntOrDefault("drain_timeout", 5)
+	if err != nil {
+		goutils.WriteError("invalid drain timeout", err)
+		panic("invalid drain timeout")
+	}
+	drainTimeout = time.Duration(wait) * time.Second
+	maxStreams, err := conf.GetIntOrDefault("max_streams", 100)
+	if err != nil || maxStreams <= 0 {
+		goutils.WriteError("invalid max streams", err)
+		panic("invalid max streams")
+	}
+	streamLimit = make(chan bool, maxStreams)
+	coaPort, err = conf.GetIntOrDefault("coa_port", 3799)
+	if err != nil {
+		goutils.WriteError("invalid coa port", err)
+		panic("invalid coa port")
+	}
+	coaWait, err := conf.GetIntOrDefault("coa_timeout", 3)
+	if err != nil || coaWait <= 0 {
+		goutils.WriteError("invalid coa timeout", err)
+		panic("invalid coa timeout")
+	}
+	coaTimeout = time.Duration(coaWait) * time.Second
+	coaRetries, err = conf.GetIntOrDefault("coa_retries", 2)
+	if err != nil || coaRetries < 0 {
+		goutils.WriteError("invalid coa retries", err)
+		panic("invalid coa retries")
+	}
+	sessionAge, err := conf.GetIntOrDefault("session_timeout", 86400)
+	if err != nil || sessionAge <= 0 {
+		goutils.WriteError("invalid session timeout", err)
+		panic("invalid session timeout")
+	}
+	sessionTimeout = time.Duration(sessionAge) * time.Second
+	var tcp net.Listener
+	if conf.GetTrue("tcp") {
+		tcpPort, err := conf.GetIntOrDefault("tcp_bind", bind)
+		if err != nil {
+			goutils.WriteError("invalid tcp bind", err)
+			panic("unable to bind tcp")
+		}
+		tcp, err = listenTCP(tcpPort)
+		if logError("tcp listen", err) {
+			panic("unable to bind tcp")
 		}
-		ctx.modules = append(ctx.modules, obj)
-		ctx.module = true
 	}
 
+	var acct *net.UDPConn
+	if !accounting {
+		acctBind, err := conf.GetIntOrDefault("acct_bind", 0)
+		if err != nil {
+			goutils.WriteError("invalid accounting bind", err)
+			panic("unable to bind accounting")
+		}
+		if acctBind > 0 {
+			acct, err = listenUDP(acctBind)
+			if logError("accounting setup", err) {
+				panic("unable to bind accounting")
+			}
+		}
+	}
+	var ctrl net.Listener
+	if len(control) > 0 {
+		ctrl, err = listenControl(control)
+		if logError("control setup", err) {
+			panic("unable to listen on control socket")
+		}
+	}
+	sockets := []*net.UDPConn{proxy}
+	if acct != nil {
+		sockets = append(sockets, acct)
+	}
+	var listeners []io.Closer
+	if radsec != nil {
+		listeners = append(listeners, radsec)
+	}
+	if tcp != nil {
+		listeners = append(listeners, tcp)
+	}
+	if ctrl != nil {
+		listeners = append(listeners, ctrl)
+	}
+	stopped := make(chan bool)
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
 	go func() {
-		for _ = range c {
-			clientLock.Lock()
-			clients = make(map[string]*connection)
-			clientLock.Unlock()
-			ctx.reload()
+		for s := range c {
+			if s == syscall.SIGHUP {
+				reload(*config, *instance, *debugging, accounting)
+				continue
+			}
+			// a second signal exits (without waiting for the drain)
+			signal.Reset(syscall.SIGTERM, os.Interrupt)
+			shutdown(currentContext(), listeners, sockets)
+			close(stopped)
+			return
 		}
 	}()
 
+	if healthInterval > 0 {
+		go checkUpstreams()
+	}
+	go expireClients()
+	if dupWindow > 0 {
+		go expireDuplicates()
+	}
+	if macLimit != nil || nasLimit != nil {
+		go expireLimits()
+	}
+	if workers > 0 {
+		startWorkers(workers, depth)
+		go reportOverload()
+	}
+	if batchSize > 0 {
+		startWriter(batchSize, depth)
+	}
+	if radsec != nil {
+		goutils.WriteInfo("radsec enabled")
+		go runRadSec(radsec)
+	}
+	if tcp != nil {
+		goutils.WriteInfo("tcp enabled")
+		go runTCP(tcp)
+	}
+	if ctrl != nil {
+		goutils.WriteInfo("control enabled", control)
+		go runControl(ctrl)
+	}
+	if acct != nil {
+		goutils.WriteInfo("accounting enabled")
+		go account(acct)
+	}
 	if accounting {
 		goutils.WriteInfo("accounting mode")
-		account(ctx)
+		account(proxy)
 	} else {
-		runProxy(ctx)
+		runProxy(proxy)
 	}
+	<-stopped
 }
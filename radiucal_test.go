@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"github.com/epiphyte/radiucal/plugins"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestConnection(t *testing.T, port int) *connection {
+	cli := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	conn := getConnection(cli, &client{secret: []byte("secret")})
+	if conn == nil {
+		t.Error("unable to create connection")
+	}
+	return conn
+}
+
+func TestIdleEviction(t *testing.T) {
+	closeClients()
+	idleTimeout = time.Minute
+	maxClients = 0
+	old := newTestConnection(t, 10000)
+	cur := newTestConnection(t, 10001)
+	if len(clients) != 2 {
+		t.Error("should have 2 clients")
+	}
+	if getConnection(cur.client, cur.nas) != cur {
+		t.Error("should have reused connection")
+	}
+	old.last = time.Now().Add(-2 * time.Minute)
+	evictIdle(time.Now())
+	if len(clients) != 1 {
+		t.Error("should have evicted idle client")
+	}
+	if !old.closed() || cur.closed() {
+		t.Error("wrong client closed")
+	}
+	closeClients()
+	if len(clients) != 0 || !cur.closed() {
+		t.Error("should have closed all clients")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	closeClients()
+	idleTimeout = time.Minute
+	maxClients = 2
+	first := newTestConnection(t, 10000)
+	first.last = time.Now().Add(-time.Second)
+	second := newTestConnection(t, 10001)
+	third := newTestConnection(t, 10002)
+	if len(clients) != 2 {
+		t.Error("should be capped at 2 clients")
+	}
+	if !first.closed() || second.closed() || third.closed() {
+		t.Error("should have evicted the oldest client")
+	}
+	closeClients()
+	maxClients = 0
+}
+
+func TestForwardReply(t *testing.T) {
+	closeClients()
+	if err := setup(0); err != nil {
+		t.Error("unable to setup proxy")
+	}
+	defer proxy.Close()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	srv, _ := net.ListenUDP("udp", local)
+	defer srv.Close()
+	cli, _ := net.ListenUDP("udp", local)
+	defer cli.Close()
+	go func() {
+		var buffer [radius.MaxPacketLength]byte
+		n, addr, err := srv.ReadFromUDP(buffer[0:])
+		if err != nil {
+			return
+		}
+		p, err := radius.Parse(buffer[0:n], upstreamSecret)
+		if err != nil || !validRequest(buffer[0:n], upstreamSecret) {
+			return
+		}
+		b, _ := p.Response(radius.CodeAccountingResponse).Encode()
+		srv.WriteToUDP(b, addr)
+	}()
+	server, _ := newUpstream(srv.LocalAddr().String(), upstreamSecret)
+	cliaddr := cli.LocalAddr().(*net.UDPAddr)
+	conn := getConnection(cliaddr, &client{secret: nasSecret})
+	p := radius.New(radius.CodeAccountingRequest, nasSecret)
+	b, _ := p.Encode()
+	if err := conn.forward(requestKey(cliaddr, b), b, nil, server, udpSender(proxy, cliaddr)); err != nil {
+		t.Error("unable to forward")
+	}
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	var buffer [radius.MaxPacketLength]byte
+	n, err := cli.Read(buffer[0:])
+	if err != nil {
+		t.Error("no reply relayed")
+		return
+	}
+	request, _ := p.Encode()
+	if !validResponse(buffer[0:n], request[4:20], nasSecret) {
+		t.Error("reply not signed for the nas")
+	}
+	closeClients()
+}
+
+func TestSharedIdentifier(t *testing.T) {
+	closeClients()
+	if err := setup(0); err != nil {
+		t.Error("unable to setup proxy")
+	}
+	defer proxy.Close()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	srv, _ := net.ListenUDP("udp", local)
+	defer srv.Close()
+	cli, _ := net.ListenUDP("udp", local)
+	defer cli.Close()
+	go func() {
+		// answer both requests, accounting last
+		var replies [][]byte
+		var addr *net.UDPAddr
+		for len(replies) < 2 {
+			var buffer [radius.MaxPacketLength]byte
+			n, from, err := srv.ReadFromUDP(buffer[0:])
+			if err != nil {
+				return
+			}
+			addr = from
+			p, err := radius.Parse(buffer[0:n], upstreamSecret)
+			if err != nil {
+				return
+			}
+			code := radius.CodeAccessAccept
+			if p.Code == radius.CodeAccountingRequest {
+				code = radius.CodeAccountingResponse
+			}
+			b, _ := p.Response(code).Encode()
+			replies = append([][]byte{b}, replies...)
+		}
+		for _, b := range replies {
+			srv.WriteToUDP(b, addr)
+		}
+	}()
+	server, _ := newUpstream(srv.LocalAddr().String(), upstreamSecret)
+	cliaddr := cli.LocalAddr().(*net.UDPAddr)
+	conn := getConnection(cliaddr, &client{secret: nasSecret})
+	requests := make(map[radius.Code][]byte)
+	for _, code := range []radius.Code{radius.CodeAccessRequest, radius.CodeAccountingRequest} {
+		p := radius.New(code, nasSecret)
+		p.Identifier = 7
+		b, _ := p.Encode()
+		// forward translates b in place
+		requests[code], _ = p.Encode()
+		if err := conn.forward(requestKey(cliaddr, b), b, nil, server, udpSender(proxy, cliaddr)); err != nil {
+			t.Error("unable to forward")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		cli.SetReadDeadline(time.Now().Add(time.Second))
+		var buffer [radius.MaxPacketLength]byte
+		n, err := cli.Read(buffer[0:])
+		if err != nil {
+			t.Error("reply not relayed", i)
+			break
+		}
+		request := requests[radius.CodeAccountingRequest]
+		if radius.Code(buffer[0]) == radius.CodeAccessAccept {
+			request = requests[radius.CodeAccessRequest]
+		}
+		if !validResponse(buffer[0:n], request[4:20], nasSecret) {
+			t.Error("reply not matched to its request", radius.Code(buffer[0]))
+		}
+	}
+	closeClients()
+}
+
+func TestForwardTCP(t *testing.T) {
+	closeClients()
+	if err := setup(0); err != nil {
+		t.Error("unable to setup proxy")
+	}
+	defer proxy.Close()
+	srv, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer srv.Close()
+	cli, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer cli.Close()
+	go func() {
+		stream, err := srv.Accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		var buffer [radius.MaxPacketLength]byte
+		n, err := readPacket(stream, buffer[0:])
+		if err != nil || !validRequest(buffer[0:n], upstreamSecret) {
+			return
+		}
+		p, _ := radius.Parse(buffer[0:n], upstreamSecret)
+		b, _ := p.Response(radius.CodeAccountingResponse).Encode()
+		stream.Write(b)
+		stream.Read(buffer[0:])
+	}()
+	server, _ := newUpstream(tcpScheme+srv.Addr().String(), upstreamSecret)
+	if !server.tcp || server.addr.String() != srv.Addr().String() {
+		t.Error("should be a tcp upstream")
+	}
+	cliaddr := cli.LocalAddr().(*net.UDPAddr)
+	conn := getConnection(cliaddr, &client{secret: nasSecret})
+	p := radius.New(radius.CodeAccountingRequest, nasSecret)
+	b, _ := p.Encode()
+	if err := conn.forward(requestKey(cliaddr, b), b, nil, server, udpSender(proxy, cliaddr)); err != nil {
+		t.Error("unable to forward", err)
+	}
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	var buffer [radius.MaxPacketLength]byte
+	n, err := cli.Read(buffer[0:])
+	if err != nil {
+		t.Error("no reply relayed")
+		return
+	}
+	request, _ := p.Encode()
+	if !validResponse(buffer[0:n], request[4:20], nasSecret) {
+		t.Error("reply not signed for the nas")
+	}
+	closeClients()
+}
+
+func TestAuthAndAccounting(t *testing.T) {
+	closeClients()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	auth, _ := net.ListenUDP("udp", local)
+	acct, _ := net.ListenUDP("udp", local)
+	ctx, request := getPacket(t)
+	m := &MockModule{fail: true}
+	ctx.use("mock", m)
+	setContext(ctx)
+	served := make(chan bool, 2)
+	go func() {
+		runProxy(auth)
+		served <- true
+	}()
+	go func() {
+		account(acct)
+		served <- true
+	}()
+	cli, _ := net.ListenUDP("udp", local)
+	defer cli.Close()
+	p := radius.New(radius.CodeAccountingRequest, ctx.secret)
+	accounting, _ := p.Encode()
+	cli.WriteToUDP(request, auth.LocalAddr().(*net.UDPAddr))
+	cli.WriteToUDP(accounting, acct.LocalAddr().(*net.UDPAddr))
+	var buffer [radius.MaxPacketLength]byte
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		n, from, err := cli.ReadFromUDP(buffer[0:])
+		if err != nil {
+			t.Error("no reply", err)
+			break
+		}
+		expect := radius.CodeAccessReject
+		socket := auth
+		if radius.Code(buffer[0]) == radius.CodeAccountingResponse {
+			expect = radius.CodeAccountingResponse
+			socket = acct
+		}
+		if radius.Code(buffer[0]) != expect || from.Port != socket.LocalAddr().(*net.UDPAddr).Port || n < 20 {
+			t.Error("reply from the wrong socket")
+		}
+	}
+	// requests are handled by the readers, done once they stop
+	auth.Close()
+	acct.Close()
+	<-served
+	<-served
+	if m.pre != 1 || m.acct != 1 {
+		t.Error("plugins should be shared")
+	}
+	setContext(&context{})
+}
+
+func TestLocalDecisions(t *testing.T) {
+	closeClients()
+	ctx, request := getPacket(t)
+	m := &DecidingModule{decision: &plugins.Decision{Action: plugins.Accept}}
+	post := &MockModule{}
+	ctx.use("decide", m)
+	ctx.postauth = true
+	ctx.postauths = append(ctx.postauths, post)
+	cli := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10001}
+	var sent [][]byte
+	send := func(b []byte) error {
+		sent = append(sent, b)
+		return nil
+	}
+	authenticate(ctx, request, cli, localNAS(ctx), send)
+	if len(sent) != 1 || radius.Code(sent[0][0]) != radius.CodeAccessAccept || post.post != 1 {
+		t.Error("should have accepted locally")
+	}
+	m.decision = &plugins.Decision{Action: plugins.Drop}
+	request[1]++
+	authenticate(ctx, request, cli, localNAS(ctx), send)
+	m.decision = &plugins.Decision{Action: plugins.Reject}
+	ctx.noreject = true
+	request[1]++
+	authenticate(ctx, request, cli, localNAS(ctx), send)
+	if len(sent) != 1 {
+		t.Error("should have dropped")
+	}
+	ctx.noreject = false
+	request[1]++
+	authenticate(ctx, request, cli, localNAS(ctx), send)
+	if len(sent) != 2 || radius.Code(sent[1][0]) != radius.CodeAccessReject {
+		t.Error("should have rejected")
+	}
+	if len(clients) != 0 {
+		t.Error("local decisions need no upstream connection")
+	}
+	closeClients()
+}
+
+type RewritingModule struct {
+	MockModule
+}
+
+func (m *RewritingModule) Rewrite(p *radius.Packet) bool {
+	rfc2865.UserName_SetString(p, "rewritten")
+	return true
+}
+
+func TestRewriteRequest(t *testing.T) {
+	ctx, b := getPacket(t)
+	nas := localNAS(ctx)
+	p, _ := ctx.packet(b, nas)
+	if r, err := ctx.rewriteRequest(p, nas); r != nil || err != nil {
+		t.Error("no rewriting modules")
+	}
+	ctx.use("rewrite", &RewritingModule{})
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, authenticatorLength))
+	r, err := ctx.rewriteRequest(p, nas)
+	if err != nil || !bytes.Equal(r[4:20], b[4:20]) || !validMessageAuthenticator(r, b[4:20], nas.secret) {
+		t.Error("should be re-encoded and signed", err)
+	}
+	if rewritten, _ := ctx.packet(r, nas); rfc2865.UserName_GetString(rewritten) != "rewritten" {
+		t.Error("should be rewritten")
+	}
+}
+
+func TestRewriteAccounting(t *testing.T) {
+	rewriteAccounting(t, upstreamSecret)
+	// nothing to translate, the reply still has to be signed for the original request
+	rewriteAccounting(t, nasSecret)
+}
+
+func rewriteAccounting(t *testing.T, secret []byte) {
+	closeClients()
+	if err := setup(0); err != nil {
+		t.Error("unable to setup proxy")
+	}
+	defer proxy.Close()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	srv, _ := net.ListenUDP("udp", local)
+	defer srv.Close()
+	cli, _ := net.ListenUDP("udp", local)
+	defer cli.Close()
+	users := make(chan string, 1)
+	go func() {
+		var buffer [radius.MaxPacketLength]byte
+		n, addr, err := srv.ReadFromUDP(buffer[0:])
+		if err != nil {
+			return
+		}
+		p, err := radius.Parse(buffer[0:n], secret)
+		if err != nil || !validRequest(buffer[0:n], secret) {
+			return
+		}
+		users <- rfc2865.UserName_GetString(p)
+		b, _ := p.Response(radius.CodeAccountingResponse).Encode()
+		srv.WriteToUDP(b, addr)
+	}()
+	ctx := &context{}
+	ctx.use("rewrite", &RewritingModule{})
+	server, _ := newUpstream(srv.LocalAddr().String(), secret)
+	nas := &client{secret: nasSecret}
+	cliaddr := cli.LocalAddr().(*net.UDPAddr)
+	conn := getConnection(cliaddr, nas)
+	p := radius.New(radius.CodeAccountingRequest, nasSecret)
+	rfc2865.UserName_SetString(p, "user")
+	request, _ := p.Encode()
+	parsed, _ := ctx.packet(request, nas)
+	b, err := rewritten(ctx, request, parsed, nas)
+	if err != nil || !validRequest(b, nasSecret) || bytes.Equal(b, request) {
+		t.Error("should be rewritten and signed")
+	}
+	key := requestKey(cliaddr, request)
+	dupWindow = time.Minute
+	checkDuplicate(key, time.Now())
+	if err := conn.forward(key, b, parsed, server, udpSender(proxy, cliaddr)); err != nil {
+		t.Error("unable to forward")
+	}
+	if <-users != "rewritten" {
+		t.Error("should forward the rewritten request")
+	}
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	var buffer [radius.MaxPacketLength]byte
+	n, err := cli.Read(buffer[0:])
+	if err != nil || !validResponse(buffer[0:n], request[4:20], nasSecret) {
+		t.Error("reply should be signed for the original request", err)
+	}
+	// a retransmission (of the request as sent by the NAS) gets the reply
+	if reply, ok := checkDuplicate(key, time.Now()); !ok || !bytes.Equal(reply, buffer[0:n]) {
+		t.Error("should have cached the reply for the original request")
+	}
+	dupWindow = 0
+	evictDuplicates(time.Now().Add(time.Minute))
+	closeClients()
+}
+
+type ReplyRewritingModule struct {
+	MockModule
+}
+
+func (m *ReplyRewritingModule) RewriteReply(request, reply *radius.Packet) bool {
+	if reply.Code != radius.CodeAccessAccept {
+		return false
+	}
+	rfc2865.FilterID_SetString(reply, rfc2865.UserName_GetString(request))
+	return true
+}
+
+func TestRewriteReply(t *testing.T) {
+	ctx, b := getPacket(t)
+	nas := localNAS(ctx)
+	p, _ := ctx.packet(b, nas)
+	accept := response(p, radius.CodeAccessAccept)
+	rfc2869.MessageAuthenticator_Set(accept, make([]byte, authenticatorLength))
+	reply, _ := accept.Encode()
+	signPacket(reply, nas.secret, b[4:20])
+	if resp, r, err := ctx.rewriteReply(p, reply, nas, b[4:20]); resp == nil || r != nil || err != nil {
+		t.Error("no reply rewriting modules")
+	}
+	ctx.use("reply", &ReplyRewritingModule{})
+	resp, r, err := ctx.rewriteReply(p, reply, nas, b[4:20])
+	if err != nil || !validResponse(r, b[4:20], nas.secret) || !validMessageAuthenticator(r, b[4:20], nas.secret) {
+		t.Error("should be re-encoded and signed", err)
+	}
+	if rewritten, _ := ctx.packet(r, nas); rfc2865.FilterID_GetString(rewritten) != "user" {
+		t.Error("should be rewritten")
+	}
+	if rfc2865.FilterID_GetString(resp) != "user" {
+		t.Error("should return the rewritten reply")
+	}
+	reject, _ := response(p, radius.CodeAccessReject).Encode()
+	if resp, r, err := ctx.rewriteReply(p, reject, nas, b[4:20]); resp.Code != radius.CodeAccessReject || r != nil || err != nil {
+		t.Error("unchanged replies are relayed as is")
+	}
+	if _, r, _ := ctx.rewriteReply(nil, reply, nas, b[4:20]); r != nil {
+		t.Error("no request, nothing to rewrite")
+	}
+	if resp, r, err := ctx.rewriteReply(p, reply[0:10], nas, b[4:20]); resp != nil || r != nil || err != nil {
+		t.Error("unparsed replies are relayed as is")
+	}
+}
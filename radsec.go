@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	// rfc6614 secret
+	radsecSecret     = "radsec"
+	handshakeTimeout = 10 * time.Second
+)
+
+// load the server certificate/key (optionally encrypted) and the CA to verify clients
+func radsecConfig(certFile, keyFile, password, caFile string) (*tls.Config, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err = decryptKey(keyPEM, password)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("invalid CA certificate")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// decrypt a legacy encrypted PEM key or a PKCS#8 "ENCRYPTED PRIVATE KEY" (as openssl writes it), others are kept
+func decryptKey(keyPEM []byte, password string) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("invalid server key")
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		der, err := x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+	}
+	if block.Type != "ENCRYPTED PRIVATE KEY" {
+		return keyPEM, nil
+	}
+	der, err := decryptPKCS8(block.Bytes, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func listenRadSec(port int, config *tls.Config) (net.Listener, error) {
+	return tls.Listen("tcp", fmt.Sprintf(":%d", port), config)
+}
+
+// accept radsec clients, each is identified by its (verified) certificate
+func runRadSec(listener net.Listener) {
+	acceptStreams(listener, func(conn net.Conn) {
+		handshake(conn.(*tls.Conn))
+	})
+}
+
+func handshake(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		goutils.WriteInfo("radsec handshake failed", conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	network, err := parseNetwork(addr.IP.String())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	nas := &client{network: network, secret: []byte(radsecSecret)}
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) > 0 {
+		nas.name = state.PeerCertificates[0].Subject.CommonName
+	}
+	goutils.WriteDebug("radsec client connected", nas.String(), addr.String())
+	serveStream(conn, nas)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCert(t *testing.T, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Error("unable to generate key")
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Error("unable to create certificate")
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestRadSec(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "radsec")
+	defer os.RemoveAll(dir)
+	ca, caKey, caPEM, _ := newCert(t, "ca", 1, nil, nil)
+	_, _, srvPEM, srvKey := newCert(t, "server", 2, ca, caKey)
+	_, _, cliPEM, cliKey := newCert(t, "ap1", 3, ca, caKey)
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), caPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "server.pem"), srvPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "server.key"), srvKey, 0600)
+	if _, err := radsecConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), "", filepath.Join(dir, "none")); err == nil {
+		t.Error("no CA")
+	}
+	config, err := radsecConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), "", filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Error("unable to load radsec config", err)
+		return
+	}
+	listener, err := listenRadSec(0, config)
+	if err != nil {
+		t.Error("unable to listen")
+		return
+	}
+	defer listener.Close()
+	setContext(&context{})
+	go runRadSec(listener)
+
+	pair, _ := tls.X509KeyPair(cliPEM, cliKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{Certificates: []tls.Certificate{pair}, RootCAs: roots, ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Error("unable to connect", err)
+		return
+	}
+	defer conn.Close()
+	p := radius.New(radius.CodeStatusServer, []byte(radsecSecret))
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, authenticatorLength))
+	b, _ := p.Encode()
+	signPacket(b, []byte(radsecSecret), nil)
+	conn.Write(b)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buffer [radius.MaxPacketLength]byte
+	n, err := readPacket(conn, buffer[0:])
+	if err != nil {
+		t.Error("no status response", err)
+		return
+	}
+	if radius.Code(buffer[0]) != radius.CodeAccessAccept || !validResponse(buffer[0:n], b[4:20], []byte(radsecSecret)) {
+		t.Error("invalid status response")
+	}
+
+	// no client certificate
+	anon, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err == nil {
+		anon.Write(b)
+		anon.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := readPacket(anon, buffer[0:]); err == nil {
+			t.Error("should not serve clients without certificates")
+		}
+		anon.Close()
+	}
+}
+
+func TestEncryptedKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "radsec")
+	defer os.RemoveAll(dir)
+	// openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA256 (the default) and -v2 des3 -v2prf hmacWithSHA1
+	for _, file := range []string{"./tests/radsec.aes.key", "./tests/radsec.des3.key"} {
+		encrypted, _ := ioutil.ReadFile(file)
+		if _, err := decryptKey(encrypted, "wrong"); err == nil {
+			t.Error("should not decrypt with the wrong password", file)
+		}
+		keyPEM, err := decryptKey(encrypted, "radiucal")
+		if err != nil {
+			t.Error("unable to decrypt", file, err)
+			continue
+		}
+		block, _ := pem.Decode(keyPEM)
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			t.Error("invalid key", file, err)
+			continue
+		}
+		key := parsed.(*ecdsa.PrivateKey)
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "server"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+		der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		ioutil.WriteFile(filepath.Join(dir, "server.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+		if _, err := radsecConfig(filepath.Join(dir, "server.pem"), file, "radiucal", filepath.Join(dir, "server.pem")); err != nil {
+			t.Error("should load the encrypted key", file, err)
+		}
+	}
+	_, _, _, plain := newCert(t, "server", 1, nil, nil)
+	if keyPEM, err := decryptKey(plain, ""); err != nil || string(keyPEM) != string(plain) {
+		t.Error("unencrypted keys are kept")
+	}
+}
+
+func TestEncryptedKeyPadding(t *testing.T) {
+	// radsec.aes.key re-encrypted (openssl enc -aes-256-cbc -nopad, same salt and iv) with its last padding byte changed
+	encrypted, _ := ioutil.ReadFile("./tests/radsec.badpad.key")
+	if _, err := decryptKey(encrypted, "radiucal"); err != x509.IncorrectPasswordError {
+		t.Error("bad padding should be an incorrect password", err)
+	}
+	// ciphertext that is not a whole number of blocks
+	encrypted, _ = ioutil.ReadFile("./tests/radsec.aes.key")
+	block, _ := pem.Decode(encrypted)
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		t.Fatal("unable to parse", err)
+	}
+	info.EncryptedData = info.EncryptedData[:len(info.EncryptedData)-1]
+	der, _ := asn1.Marshal(info)
+	if _, err := decryptPKCS8(der, []byte("radiucal")); err == nil {
+		t.Error("should not decrypt a truncated key")
+	}
+	info.EncryptedData = nil
+	der, _ = asn1.Marshal(info)
+	if _, err := decryptPKCS8(der, []byte("radiucal")); err == nil {
+		t.Error("should not decrypt an empty key")
+	}
+}
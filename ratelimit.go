@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// nil when disabled
+	macLimit   *limiter
+	nasLimit   *limiter
+	rateReject bool
+)
+
+// token buckets by key, refilled at a rate (per minute) up to the burst
+type limiter struct {
+	name    string
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	limited int
+	lock    *sync.Mutex
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(name string, perMinute, burst int) *limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &limiter{name: name,
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		lock:    new(sync.Mutex)}
+}
+
+// take a token for the key, false when it has been exhausted
+func (l *limiter) allow(key string, now time.Time) bool {
+	if l == nil || len(key) == 0 {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		l.limited++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// drop buckets that are full again, report (and reset) the limited count
+func (l *limiter) evict(now time.Time) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+	limited := l.limited
+	l.limited = 0
+	return limited
+}
+
+// normalized Calling-Station-ID (mac) of a request
+func callingStation(p *radius.Packet) string {
+	if p == nil {
+		return ""
+	}
+	calling, err := rfc2865.CallingStationID_LookupString(p)
+	if err != nil {
+		return ""
+	}
+	return normalizeMAC(calling)
+}
+
+// lowercase hex digits only (drops separators)
+func normalizeMAC(mac string) string {
+	result := ""
+	for _, c := range strings.ToLower(mac) {
+		if (c >= 'a' && c <= 'f') || (c >= '0' && c <= '9') {
+			result = result + string(c)
+		}
+	}
+	return result
+}
+
+// check a request against the mac and nas limits, a NAS is limited by its address
+// (not its clients entry, a network may have many NAS)
+func rateLimited(p *radius.Packet, addr net.IP, now time.Time) bool {
+	if !macLimit.allow(callingStation(p), now) {
+		goutils.WriteDebug("rate limited (mac)", callingStation(p))
+		return true
+	}
+	if addr != nil && !nasLimit.allow(addr.String(), now) {
+		goutils.WriteDebug("rate limited (nas)", addr.String())
+		return true
+	}
+	return false
+}
+
+func expireLimits() {
+	for now := range time.Tick(time.Minute) {
+		for _, l := range []*limiter{macLimit, nasLimit} {
+			if l == nil {
+				continue
+			}
+			if limited := l.evict(now); limited > 0 {
+				goutils.WriteInfo("rate limited", l.name, fmt.Sprintf("%d", limited))
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/epiphyte/radiucal/plugins"
+	"layeh.com/radius"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	var disabled *limiter
+	if newLimiter("none", 0, 10) != nil || !disabled.allow("key", time.Now()) {
+		t.Error("should be disabled")
+	}
+	l := newLimiter("test", 60, 2)
+	now := time.Now()
+	if !l.allow("a", now) || !l.allow("a", now) {
+		t.Error("should allow the burst")
+	}
+	if l.allow("a", now) {
+		t.Error("should be limited")
+	}
+	if !l.allow("b", now) {
+		t.Error("other keys are not limited")
+	}
+	if !l.allow("a", now.Add(time.Second)) || l.allow("a", now.Add(time.Second)) {
+		t.Error("should refill one token per second")
+	}
+	if l.evict(now.Add(time.Second)) != 2 || len(l.buckets) != 1 {
+		t.Error("should have evicted the full bucket and counted limited requests")
+	}
+	if l.evict(now.Add(time.Minute)) != 0 || len(l.buckets) != 0 {
+		t.Error("should have evicted all buckets")
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	ctx, b := getPacket(t)
+	p, _ := ctx.packet(b, localNAS(ctx))
+	if callingStation(p) != "112233445566" || callingStation(nil) != "" {
+		t.Error("invalid calling station")
+	}
+	macLimit = newLimiter("mac", 1, 1)
+	now := time.Now()
+	local := net.ParseIP("127.0.0.1")
+	if rateLimited(p, local, now) || !rateLimited(p, local, now) {
+		t.Error("should limit by mac")
+	}
+	macLimit = nil
+	nasLimit = newLimiter("nas", 1, 1)
+	if rateLimited(p, local, now) || !rateLimited(nil, local, now) {
+		t.Error("should limit by nas")
+	}
+	// each NAS of a clients network has its own limit
+	if rateLimited(nil, net.ParseIP("127.0.0.2"), now) {
+		t.Error("should limit each nas")
+	}
+
+	// rejected before preauth
+	rateReject = true
+	cli, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer cli.Close()
+	if err := setup(0); err != nil {
+		t.Error("unable to setup proxy")
+	}
+	defer proxy.Close()
+	m := &MockModule{}
+	ctx.preauth = true
+	ctx.preauths = append(ctx.preauths, plugins.AsDeciding(m))
+	cliaddr := cli.LocalAddr().(*net.UDPAddr)
+	authenticate(ctx, b, cliaddr, localNAS(ctx), udpSender(proxy, cliaddr))
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	var buffer [radius.MaxPacketLength]byte
+	if _, err := cli.Read(buffer[0:]); err != nil || radius.Code(buffer[0]) != radius.CodeAccessReject {
+		t.Error("should have rejected")
+	}
+	if m.pre != 0 {
+		t.Error("should not reach plugins")
+	}
+	nasLimit = nil
+	rateReject = false
+	closeClients()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/epiphyte/radiucal/plugins"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// attributes requests can be routed on
+const (
+	matchRealm         = "realm"
+	matchNASID         = "nas-id"
+	matchNASIP         = "nas-ip"
+	matchSSID          = "ssid"
+	matchCalledStation = "called-station"
+	matchNASPortType   = "nas-port-type"
+)
+
+// route to a pool when an attribute of the request matches
+type rule struct {
+	attribute string
+	// glob pattern (lowercase unless an SSID), port type number or network
+	value   string
+	network *net.IPNet
+	pool    string
+	// strip the realm (if any) from the User-Name
+	strip bool
+}
+
+// first matching rule selects the pool, otherwise the fallback
+type routes struct {
+	rules    []*rule
+	fallback string
+}
+
+// parse "<attribute> <value> <pool> [strip]" rules then "<realm> <pool> [strip]" rules, every pool must be configured
+func parseRoutes(attributes, realms []string, fallback string, servers map[string]*pool) (*routes, error) {
+	r := &routes{fallback: fallback}
+	if _, ok := servers[fallback]; !ok {
+		return nil, errors.New(fmt.Sprintf("unknown default route pool: %s", fallback))
+	}
+	var definitions []string
+	definitions = append(definitions, attributes...)
+	for _, realm := range realms {
+		definitions = append(definitions, fmt.Sprintf("%s %s", matchRealm, realm))
+	}
+	for _, definition := range definitions {
+		parts := strings.Fields(definition)
+		if len(parts) < 3 || len(parts) > 4 || (len(parts) == 4 && parts[3] != "strip") {
+			return nil, errors.New(fmt.Sprintf("invalid route: %s", definition))
+		}
+		if _, ok := servers[parts[2]]; !ok {
+			return nil, errors.New(fmt.Sprintf("unknown pool for route: %s", definition))
+		}
+		rule, err := newRule(parts[0], parts[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid route: %s (%s)", definition, err))
+		}
+		rule.pool = parts[2]
+		rule.strip = len(parts) == 4
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func newRule(attribute, value string) (*rule, error) {
+	r := &rule{attribute: attribute, value: value}
+	switch attribute {
+	case matchRealm, matchNASID, matchCalledStation:
+		r.value = strings.ToLower(value)
+	case matchSSID:
+	case matchNASIP:
+		network, err := parseNetwork(value)
+		if err != nil {
+			return nil, err
+		}
+		r.network = network
+	case matchNASPortType:
+		if _, err := strconv.ParseUint(value, 10, 32); err == nil {
+			break
+		}
+		for t, name := range rfc2865.NASPortType_Strings {
+			if strings.EqualFold(name, value) {
+				r.value = fmt.Sprintf("%d", t)
+			}
+		}
+		if r.value == value {
+			return nil, errors.New("unknown port type")
+		}
+		return r, nil
+	default:
+		return nil, errors.New("unknown attribute")
+	}
+	if r.network == nil {
+		if _, err := path.Match(r.value, ""); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// glob match, an unset attribute never matches
+func glob(pattern, value string, err error) bool {
+	if err != nil {
+		return false
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+func (r *rule) matches(p *radius.Packet) bool {
+	switch r.attribute {
+	case matchRealm:
+		user, err := rfc2865.UserName_LookupString(p)
+		if err != nil {
+			return false
+		}
+		// a user without a realm never matches
+		realm, _ := plugins.SplitRealm(user)
+		return len(realm) > 0 && glob(r.value, strings.ToLower(realm), nil)
+	case matchNASID:
+		id, err := rfc2865.NASIdentifier_LookupString(p)
+		return glob(r.value, strings.ToLower(id), err)
+	case matchCalledStation:
+		called, err := rfc2865.CalledStationID_LookupString(p)
+		return glob(r.value, strings.ToLower(called), err)
+	case matchSSID:
+		called, err := rfc2865.CalledStationID_LookupString(p)
+		if err != nil {
+			return false
+		}
+		ssid, ok := calledSSID(called)
+		return ok && glob(r.value, ssid, nil)
+	case matchNASIP:
+		ip, err := rfc2865.NASIPAddress_Lookup(p)
+		return err == nil && r.network.Contains(ip)
+	case matchNASPortType:
+		t, err := rfc2865.NASPortType_Lookup(p)
+		return err == nil && fmt.Sprintf("%d", t) == r.value
+	}
+	return false
+}
+
+func (r *rule) String() string {
+	rule := fmt.Sprintf("%s %s -> %s", r.attribute, r.value, r.pool)
+	if r.network != nil {
+		rule = fmt.Sprintf("%s %s -> %s", r.attribute, r.network.String(), r.pool)
+	}
+	if r.strip {
+		rule = rule + " (strip)"
+	}
+	return rule
+}
+
+// the ssid of a Called-Station-Id (<mac>:<ssid>, rfc3580), the mac must be complete
+func calledSSID(called string) (string, bool) {
+	for _, n := range []int{17, 14, 12} {
+		if len(called) > n && called[n] == ':' && isMAC(called[:n]) {
+			return called[n+1:], true
+		}
+	}
+	return "", false
+}
+
+// a mac as 12 hex digits, bare or separated (consistently) by - or : per octet or . per 2 octets
+func isMAC(mac string) bool {
+	group := 0
+	var sep rune
+	switch len(mac) {
+	case 12:
+	case 14:
+		group = 4
+		sep = '.'
+	case 17:
+		group = 2
+		sep = rune(mac[2])
+		if sep != '-' && sep != ':' {
+			return false
+		}
+	default:
+		return false
+	}
+	for i, c := range strings.ToLower(mac) {
+		if group > 0 && (i+1)%(group+1) == 0 {
+			if c != sep {
+				return false
+			}
+			continue
+		}
+		if (c < 'a' || c > 'f') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// the pool for a request and, when the realm is to be stripped, the user without it
+func (r *routes) match(p *radius.Packet) (string, string, bool) {
+	if r == nil {
+		return defaultPool, "", false
+	}
+	if p == nil {
+		return r.fallback, "", false
+	}
+	for _, rule := range r.rules {
+		if !rule.matches(p) {
+			continue
+		}
+		if rule.strip {
+			if user, err := rfc2865.UserName_LookupString(p); err == nil {
+				if realm, stripped := plugins.SplitRealm(user); len(realm) > 0 {
+					return rule.pool, stripped, true
+				}
+			}
+		}
+		return rule.pool, "", false
+	}
+	return r.fallback, "", false
+}
+
+func (r *routes) String() string {
+	if r == nil {
+		return ""
+	}
+	var rules []string
+	for _, rule := range r.rules {
+		rules = append(rules, rule.String())
+	}
+	rules = append(rules, fmt.Sprintf("default -> %s", r.fallback))
+	return strings.Join(rules, ", ")
+}
+
+// select the pool for a request, a copy of the request is re-encoded when its realm is stripped
+// (the request stays as sent by the NAS for the reply and plugins)
+func route(ctx *context, buffered []byte, p *radius.Packet, nas *client) (*pool, []byte, error) {
+	name, user, strip := ctx.routes.match(p)
+	servers := getPool(name)
+	if servers == nil {
+		return nil, nil, errors.New(fmt.Sprintf("no upstream pool: %s", name))
+	}
+	if !strip {
+		return servers, buffered, nil
+	}
+	stripped := copyPacket(p)
+	if err := rfc2865.UserName_SetString(stripped, user); err != nil {
+		return nil, nil, err
+	}
+	b, err := encodeRequest(stripped, nas.secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return servers, b, nil
+}
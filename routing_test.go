@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"github.com/epiphyte/radiucal/plugins"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"net"
+	"testing"
+	"time"
+)
+
+func testPools(t *testing.T, names ...string) map[string]*pool {
+	servers := make(map[string]*pool)
+	for i, name := range names {
+		p, err := newPool(name, []string{fmt.Sprintf("127.0.0.1:%d", 1812+i)}, nil, []byte("secret"))
+		if err != nil {
+			t.Fatal("unable to create pool", err)
+		}
+		servers[name] = p
+	}
+	return servers
+}
+
+func TestSplitRealm(t *testing.T) {
+	for _, c := range [][]string{
+		{"user@example.com", "example.com", "user"},
+		{"user@sub@example.com", "example.com", "user@sub"},
+		{"EXAMPLE\\user", "EXAMPLE", "user"},
+		{"user", "", "user"},
+		{"user@", "", "user@"},
+		{"@example.com", "", "@example.com"},
+		{"\\user", "", "\\user"},
+	} {
+		if realm, user := plugins.SplitRealm(c[0]); realm != c[1] || user != c[2] {
+			t.Error("invalid split", c, realm, user)
+		}
+	}
+}
+
+func TestCalledSSID(t *testing.T) {
+	for _, c := range [][]string{
+		{"11-22-33-44-55-66:Guest", "Guest"},
+		{"11:22:33:44:55:66:Guest:Net", "Guest:Net"},
+		{"1122.3344.5566:Guest", "Guest"},
+		{"112233445566:Guest", "Guest"},
+		{"AA-BB-CC-DD-EE-FF:", ""},
+	} {
+		if ssid, ok := calledSSID(c[0]); !ok || ssid != c[1] {
+			t.Error("invalid ssid", c, ssid)
+		}
+	}
+	for _, c := range []string{
+		"11-22-33-44-55-66",
+		"11-22-33-44-55:Guest",
+		"11-22:33-44-55-66:Guest",
+		"zz-22-33-44-55-66:Guest",
+		"lobby:Guest",
+		"",
+	} {
+		if _, ok := calledSSID(c); ok {
+			t.Error("no ssid", c)
+		}
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	servers := testPools(t, defaultPool, "guest", "staff")
+	for _, rules := range [][]string{
+		{"example.com"},
+		{"example.com unknown"},
+		{"example.com staff trim"},
+		{"example.com staff strip extra"},
+		{"[ staff"},
+	} {
+		if _, err := parseRoutes(nil, rules, defaultPool, servers); err == nil {
+			t.Error("should be invalid", rules)
+		}
+	}
+	for _, rules := range [][]string{
+		{"nas-id ap"},
+		{"unknown value staff"},
+		{"nas-ip 10.0.0.0/33 staff"},
+		{"nas-port-type wifi staff"},
+		{"ssid [ staff"},
+	} {
+		if _, err := parseRoutes(rules, nil, defaultPool, servers); err == nil {
+			t.Error("should be invalid", rules)
+		}
+	}
+	if _, err := parseRoutes(nil, nil, "unknown", servers); err == nil {
+		t.Error("should have an existing default route")
+	}
+	r, err := parseRoutes(nil, []string{"guest.example.com guest strip", "*.Example.com staff", "* default"}, "staff", servers)
+	if err != nil {
+		t.Error("should be valid", err)
+	}
+	if r.String() != "realm guest.example.com -> guest (strip), realm *.example.com -> staff, realm * -> default, default -> staff" {
+		t.Error("invalid routes", r.String())
+	}
+	p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	for _, c := range []struct {
+		user  string
+		pool  string
+		strip bool
+	}{
+		{"user@guest.example.com", "guest", true},
+		{"user@STAFF.EXAMPLE.COM", "staff", false},
+		{"a.example.com\\user", "staff", false},
+		{"user@other.com", defaultPool, false},
+		{"user", "staff", false},
+	} {
+		rfc2865.UserName_SetString(p, c.user)
+		if name, user, strip := r.match(p); name != c.pool || strip != c.strip || (strip && user != "user") {
+			t.Error("invalid route", c, name, user, strip)
+		}
+	}
+	var none *routes
+	if name, _, _ := none.match(p); name != defaultPool {
+		t.Error("should route to the default pool")
+	}
+}
+
+func TestAttributeRoutes(t *testing.T) {
+	servers := testPools(t, defaultPool, "guest", "staff")
+	r, err := parseRoutes([]string{
+		"nas-id lobby-* guest",
+		"ssid Guest* guest strip",
+		"called-station aa-bb-cc-dd-ee-ff:* staff",
+		"nas-ip 10.1.0.0/16 staff",
+		"nas-port-type ethernet staff",
+		"nas-port-type 5 guest",
+	}, []string{"example.com guest"}, defaultPool, servers)
+	if err != nil {
+		t.Fatal("should be valid", err)
+	}
+	if r.String() != "nas-id lobby-* -> guest, ssid Guest* -> guest (strip), called-station aa-bb-cc-dd-ee-ff:* -> staff, nas-ip 10.1.0.0/16 -> staff, nas-port-type 15 -> staff, nas-port-type 5 -> guest, realm example.com -> guest, default -> default" {
+		t.Error("invalid routes", r.String())
+	}
+	for _, c := range []struct {
+		set   func(p *radius.Packet)
+		pool  string
+		strip bool
+	}{
+		{func(p *radius.Packet) { rfc2865.NASIdentifier_SetString(p, "Lobby-AP1") }, "guest", false},
+		{func(p *radius.Packet) { rfc2865.CalledStationID_SetString(p, "11-22-33-44-55-66:GuestNet") }, "guest", true},
+		{func(p *radius.Packet) { rfc2865.CalledStationID_SetString(p, "11-22-33-44-55-66:guestnet") }, defaultPool, false},
+		{func(p *radius.Packet) { rfc2865.CalledStationID_SetString(p, "lobby:GuestNet") }, defaultPool, false},
+		{func(p *radius.Packet) { rfc2865.CalledStationID_SetString(p, "AA-BB-CC-DD-EE-FF:Staff") }, "staff", false},
+		{func(p *radius.Packet) { rfc2865.NASIPAddress_Set(p, net.ParseIP("10.1.2.3")) }, "staff", false},
+		{func(p *radius.Packet) { rfc2865.NASIPAddress_Set(p, net.ParseIP("10.2.2.3")) }, defaultPool, false},
+		{func(p *radius.Packet) { rfc2865.NASPortType_Set(p, rfc2865.NASPortType_Value_Ethernet) }, "staff", false},
+		{func(p *radius.Packet) { rfc2865.NASPortType_Set(p, rfc2865.NASPortType_Value_Virtual) }, "guest", false},
+		{func(p *radius.Packet) { rfc2865.UserName_SetString(p, "user@example.com") }, "guest", false},
+	} {
+		p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+		rfc2865.UserName_SetString(p, "user@example.org")
+		c.set(p)
+		if name, user, strip := r.match(p); name != c.pool || strip != c.strip || (strip && user != "user") {
+			t.Error("invalid route", c.pool, name, user, strip)
+		}
+	}
+}
+
+func TestRouteRealm(t *testing.T) {
+	closeClients()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	srv, _ := net.ListenUDP("udp", local)
+	defer srv.Close()
+	servers := testPools(t, defaultPool)
+	guest, _ := newPool("guest", []string{srv.LocalAddr().String()}, nil, []byte("secret"))
+	servers["guest"] = guest
+	setPools(servers)
+	defer setPools(make(map[string]*pool))
+	ctx, _ := getPacket(t)
+	ctx.routes, _ = parseRoutes(nil, []string{"guest guest strip"}, defaultPool, servers)
+	m := &PostUserModule{users: make(chan string, 1)}
+	ctx.use("post", m)
+	// replies are relayed with the current context
+	setContext(ctx)
+	defer setContext(&context{})
+	p := radius.New(radius.CodeAccessRequest, ctx.secret)
+	rfc2865.UserName_SetString(p, "user@guest")
+	request, _ := p.Encode()
+	cli := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10002}
+	authenticate(ctx, request, cli, localNAS(ctx), func([]byte) error { return nil })
+	srv.SetReadDeadline(time.Now().Add(time.Second))
+	var buffer [radius.MaxPacketLength]byte
+	n, from, err := srv.ReadFromUDP(buffer[0:])
+	if err != nil {
+		t.Fatal("should have been routed", err)
+	}
+	forwarded, _ := radius.Parse(buffer[0:n], ctx.secret)
+	if rfc2865.UserName_GetString(forwarded) != "user" {
+		t.Error("should have stripped the realm")
+	}
+	// the reply is for the request as sent by the NAS
+	reply, _ := forwarded.Response(radius.CodeAccessAccept).Encode()
+	srv.WriteToUDP(reply, from)
+	select {
+	case user := <-m.users:
+		if user != "user@guest" {
+			t.Error("postauth should see the request as sent", user)
+		}
+	case <-time.After(time.Second):
+		t.Error("should have relayed the reply")
+	}
+	closeClients()
+}
+
+type PostUserModule struct {
+	MockModule
+	users chan string
+}
+
+func (m *PostUserModule) Post(request, reply *radius.Packet) {
+	m.users <- rfc2865.UserName_GetString(request)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"github.com/epiphyte/radiucal/plugins"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// accounted sessions by NAS and Acct-Session-Id
+	sessions    map[string]*session = make(map[string]*session)
+	sessionLock *sync.Mutex         = new(sync.Mutex)
+	// sessions without accounting for this long are forgotten
+	sessionTimeout time.Duration = 24 * time.Hour
+	// Access-Accepts not (yet) followed by accounting, by NAS and mac (or user)
+	accepts map[string]*accepted = make(map[string]*accepted)
+	// a session starting within this long is linked to the accept
+	acceptTimeout time.Duration = 5 * time.Minute
+)
+
+// an Access-Accept sent to a NAS
+type accepted struct {
+	upstream string
+	at       time.Time
+}
+
+// session as seen from accounting, enough to address it on the NAS,
+// sessions are replaced (not changed) on accounting so they can be read without the lock
+type session struct {
+	id       string
+	user     string
+	mac      string
+	calling  string
+	nasIP    net.IP
+	nasID    string
+	port     string
+	portID   string
+	framedIP net.IP
+	start    time.Time
+	input    uint64
+	output   uint64
+	// the Access-Accept preceding the session
+	authenticated time.Time
+	upstream      string
+	// where the accounting came from (the NAS is expected to listen there)
+	addr net.IP
+	nas  *client
+	last time.Time
+}
+
+func sessionKey(addr net.IP, id string) string {
+	return fmt.Sprintf("%s/%s", addr.String(), id)
+}
+
+// accepts are matched to sessions by mac (or by user without one)
+func acceptKey(addr net.IP, user, mac string) string {
+	if len(mac) > 0 {
+		return fmt.Sprintf("%s/%s", addr.String(), mac)
+	}
+	return fmt.Sprintf("%s/user:%s", addr.String(), user)
+}
+
+// address of a client (udp or stream)
+func clientIP(cliaddr net.Addr) net.IP {
+	switch a := cliaddr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// remember an Access-Accept (from an upstream or local) for the session that follows
+func trackAccept(request, reply *radius.Packet, addr net.IP, upstream string, now time.Time) {
+	if request == nil || reply == nil || addr == nil || reply.Code != radius.CodeAccessAccept {
+		return
+	}
+	user, _ := rfc2865.UserName_LookupString(request)
+	mac := callingStation(request)
+	if len(user) == 0 && len(mac) == 0 {
+		return
+	}
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	accepts[acceptKey(addr, user, mac)] = &accepted{upstream: upstream, at: now}
+}
+
+// track sessions from accounting (start/interim add or update, stop removes)
+func trackSession(p *radius.Packet, nas *client, addr net.IP, now time.Time) {
+	if p == nil || nas == nil || addr == nil {
+		return
+	}
+	status, err := rfc2866.AcctStatusType_Lookup(p)
+	if err != nil {
+		return
+	}
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	switch status {
+	case rfc2866.AcctStatusType_Value_AccountingOn, rfc2866.AcctStatusType_Value_AccountingOff:
+		// the NAS (re)started, none of its sessions remain
+		for k, s := range sessions {
+			if s.addr.Equal(addr) {
+				delete(sessions, k)
+			}
+		}
+		prefix := fmt.Sprintf("%s/", addr.String())
+		for k := range accepts {
+			if strings.HasPrefix(k, prefix) {
+				delete(accepts, k)
+			}
+		}
+		return
+	}
+	id, err := rfc2866.AcctSessionID_LookupString(p)
+	if err != nil || len(id) == 0 {
+		return
+	}
+	key := sessionKey(addr, id)
+	switch status {
+	case rfc2866.AcctStatusType_Value_Start, rfc2866.AcctStatusType_Value_InterimUpdate:
+		s := &session{id: id, start: now}
+		if old, ok := sessions[key]; ok {
+			*s = *old
+		} else if elapsed, err := rfc2866.AcctSessionTime_Lookup(p); err == nil && status == rfc2866.AcctStatusType_Value_InterimUpdate {
+			// started before we saw it
+			s.start = now.Add(-time.Duration(elapsed) * time.Second)
+		}
+		s.addr = addr
+		s.nas = nas
+		s.last = now
+		s.update(p)
+		if s.authenticated.IsZero() {
+			s.link(now)
+		}
+		sessions[key] = s
+	case rfc2866.AcctStatusType_Value_Stop:
+		delete(sessions, key)
+	}
+}
+
+// take the attributes of an accounting request (those sent)
+func (s *session) update(p *radius.Packet) {
+	if user, err := rfc2865.UserName_LookupString(p); err == nil {
+		s.user = user
+	}
+	if calling, err := rfc2865.CallingStationID_LookupString(p); err == nil {
+		s.calling = calling
+		s.mac = normalizeMAC(calling)
+	}
+	if id, err := rfc2865.NASIdentifier_LookupString(p); err == nil {
+		s.nasID = id
+	}
+	if ip, err := rfc2865.NASIPAddress_Lookup(p); err == nil {
+		s.nasIP = ip
+	}
+	if port, err := rfc2865.NASPort_Lookup(p); err == nil {
+		s.port = fmt.Sprintf("%d", port)
+	}
+	if id, err := rfc2869.NASPortID_LookupString(p); err == nil {
+		s.portID = id
+	}
+	if ip, err := rfc2865.FramedIPAddress_Lookup(p); err == nil {
+		s.framedIP = ip
+	}
+	if octets, err := rfc2866.AcctInputOctets_Lookup(p); err == nil {
+		giga, _ := rfc2869.AcctInputGigawords_Lookup(p)
+		s.input = uint64(giga)<<32 | uint64(octets)
+	}
+	if octets, err := rfc2866.AcctOutputOctets_Lookup(p); err == nil {
+		giga, _ := rfc2869.AcctOutputGigawords_Lookup(p)
+		s.output = uint64(giga)<<32 | uint64(octets)
+	}
+}
+
+// link (and consume) the Access-Accept preceding the session, requires the lock
+func (s *session) link(now time.Time) {
+	key := acceptKey(s.addr, s.user, s.mac)
+	a, ok := accepts[key]
+	if !ok {
+		return
+	}
+	delete(accepts, key)
+	if now.Sub(a.at) >= acceptTimeout {
+		return
+	}
+	s.authenticated = a.at
+	s.upstream = a.upstream
+}
+
+func forgetSession(s *session) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	delete(sessions, sessionKey(s.addr, s.id))
+}
+
+// sessions matching a user and/or a mac (empty matches any, but not both, an invalid mac matches none)
+func findSessions(user, mac string) []*session {
+	normalized := normalizeMAC(mac)
+	if (len(mac) > 0 && len(normalized) == 0) || (len(user) == 0 && len(normalized) == 0) {
+		return nil
+	}
+	mac = normalized
+	return selectSessions(func(s *session) bool {
+		if len(user) > 0 && s.user != user {
+			return false
+		}
+		return len(mac) == 0 || s.mac == mac
+	})
+}
+
+// sessions on a port (NAS-Port or NAS-Port-Id) of a NAS (NAS-IP-Address or NAS-Identifier)
+func portSessions(nas, port string) []*session {
+	if len(nas) == 0 || len(port) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(nas)
+	return selectSessions(func(s *session) bool {
+		if !strings.EqualFold(s.nasID, nas) && (ip == nil || !ip.Equal(s.nasIP)) {
+			return false
+		}
+		return s.port == port || s.portID == port
+	})
+}
+
+func selectSessions(match func(*session) bool) []*session {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	var found []*session
+	for _, s := range sessions {
+		if match(s) {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// drop sessions that have not been accounted for within the session timeout (and old accepts)
+func evictSessions(now time.Time) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	for k, s := range sessions {
+		if now.Sub(s.last) >= sessionTimeout {
+			delete(sessions, k)
+		}
+	}
+	for k, a := range accepts {
+		if now.Sub(a.at) >= acceptTimeout {
+			delete(accepts, k)
+		}
+	}
+}
+
+func (s *session) export() plugins.Session {
+	return plugins.Session{
+		ID:            s.id,
+		User:          s.user,
+		MAC:           s.mac,
+		NASIP:         s.nasIP,
+		NASID:         s.nasID,
+		Port:          s.port,
+		PortID:        s.portID,
+		FramedIP:      s.framedIP,
+		Start:         s.start,
+		InputBytes:    s.input,
+		OutputBytes:   s.output,
+		Authenticated: s.authenticated,
+		Upstream:      s.upstream,
+		Updated:       s.last,
+	}
+}
+
+func exportSessions(found []*session) []plugins.Session {
+	var result []plugins.Session
+	for _, s := range found {
+		result = append(result, s.export())
+	}
+	return result
+}
+
+// session lookups for plugins
+type sessionTable struct {
+}
+
+func (t *sessionTable) User(user string) []plugins.Session {
+	return exportSessions(findSessions(user, ""))
+}
+
+func (t *sessionTable) MAC(mac string) []plugins.Session {
+	if len(normalizeMAC(mac)) == 0 {
+		return nil
+	}
+	return exportSessions(findSessions("", mac))
+}
+
+func (t *sessionTable) Port(nas, port string) []plugins.Session {
+	return exportSessions(portSessions(nas, port))
+}
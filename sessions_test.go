@@ -0,0 +1,80 @@
+package main
+
+import (
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionTable(t *testing.T) {
+	sessions = make(map[string]*session)
+	accepts = make(map[string]*accepted)
+	ctx, b := getPacket(t)
+	nas := localNAS(ctx)
+	local := net.ParseIP("127.0.0.1")
+	now := time.Now()
+	request, _ := ctx.packet(b, nas)
+	trackAccept(request, request.Response(radius.CodeAccessReject), local, "upstream", now)
+	if len(accepts) != 0 {
+		t.Error("only accepts are tracked")
+	}
+	trackAccept(request, request.Response(radius.CodeAccessAccept), local, "upstream", now)
+	start := accountingPacket(t, rfc2866.AcctStatusType_Value_Start, "1")
+	rfc2865.NASIdentifier_SetString(start, "switch")
+	rfc2865.NASPort_Set(start, 12)
+	rfc2869.NASPortID_SetString(start, "ge-0/0/12")
+	rfc2865.FramedIPAddress_Set(start, net.ParseIP("10.0.0.2"))
+	trackSession(start, nas, local, now.Add(time.Second))
+	interim := accountingPacket(t, rfc2866.AcctStatusType_Value_InterimUpdate, "1")
+	rfc2866.AcctInputOctets_Set(interim, 10)
+	rfc2869.AcctInputGigawords_Set(interim, 1)
+	rfc2866.AcctOutputOctets_Set(interim, 20)
+	trackSession(interim, nas, local, now.Add(time.Minute))
+	table := &sessionTable{}
+	found := table.User("user")
+	if len(found) != 1 || len(accepts) != 0 {
+		t.Fatal("should track the session and link the accept")
+	}
+	s := found[0]
+	if s.ID != "1" || s.MAC != "112233445566" || s.Port != "12" || s.PortID != "ge-0/0/12" || !s.FramedIP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Error("invalid session", s)
+	}
+	if s.InputBytes != 1<<32+10 || s.OutputBytes != 20 {
+		t.Error("invalid counters", s.InputBytes, s.OutputBytes)
+	}
+	if !s.Start.Equal(now.Add(time.Second)) || !s.Updated.Equal(now.Add(time.Minute)) || !s.Authenticated.Equal(now) || s.Upstream != "upstream" {
+		t.Error("invalid times or authentication", s)
+	}
+	if len(table.MAC("11:22:33:44:55:66")) != 1 || len(table.MAC("")) != 0 || len(table.User("other")) != 0 {
+		t.Error("should find the session by mac")
+	}
+	for _, port := range [][]string{{"switch", "12"}, {"SWITCH", "ge-0/0/12"}} {
+		if len(table.Port(port[0], port[1])) != 1 {
+			t.Error("should be on the port", port)
+		}
+	}
+	for _, port := range [][]string{{"switch", "13"}, {"other", "12"}, {"switch", ""}, {"10.0.0.1", "12"}} {
+		if len(table.Port(port[0], port[1])) != 0 {
+			t.Error("should not be on the port", port)
+		}
+	}
+	// an unseen session is not linked to an old accept, its start is taken from the session time
+	trackAccept(request, request.Response(radius.CodeAccessAccept), local, "", now)
+	late := accountingPacket(t, rfc2866.AcctStatusType_Value_InterimUpdate, "2")
+	rfc2866.AcctSessionTime_Set(late, 60)
+	trackSession(late, nas, local, now.Add(acceptTimeout))
+	for _, s := range table.User("user") {
+		if s.ID == "2" && (!s.Authenticated.IsZero() || !s.Start.Equal(now.Add(acceptTimeout-time.Minute))) {
+			t.Error("should not be linked", s)
+		}
+	}
+	trackSession(accountingPacket(t, rfc2866.AcctStatusType_Value_Stop, "1"), nas, local, now)
+	if len(table.User("user")) != 1 {
+		t.Error("should have stopped the session")
+	}
+	sessions = make(map[string]*session)
+}
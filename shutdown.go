@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/epiphyte/goutils"
+	"github.com/epiphyte/radiucal/plugins"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// bounded wait for in-flight requests on shutdown
+	drainTimeout time.Duration = 5 * time.Second
+)
+
+// count requests queued or forwarded since a time still awaiting a reply
+func inflight(since time.Time) int {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	count := int(atomic.LoadInt64(&queued))
+	for _, c := range clients {
+		c.lock.Lock()
+		for _, req := range c.pending {
+			if req.sent.After(since) {
+				count++
+			}
+		}
+		c.lock.Unlock()
+	}
+	return count
+}
+
+// wait for in-flight requests, false if any remained at the timeout
+func drain() bool {
+	start := time.Now()
+	// older requests are not expected to be answered
+	since := start.Add(-drainTimeout)
+	for {
+		if inflight(since) == 0 {
+			return true
+		}
+		if time.Since(start) >= drainTimeout {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// stop modules, giving them a chance to flush
+func (ctx *context) stop() {
+	for _, m := range ctx.modules {
+		if s, ok := m.(plugins.Stoppable); ok {
+			goutils.WriteDebug("stopping module", m.Name())
+			s.Stop()
+		}
+	}
+}
+
+// stop accepting (reading from the udp sockets and streams, closing the listeners), drain, then close upstreams,
+// the streams and udp sockets (replies are sent from them while draining) and modules
+func shutdown(ctx *context, listeners []io.Closer, sockets []*net.UDPConn) {
+	goutils.WriteInfo("shutting down")
+	stopReading(sockets)
+	stopStreams()
+	for _, l := range listeners {
+		l.Close()
+	}
+	if !drain() {
+		goutils.WriteInfo("shutdown with requests in flight")
+	}
+	stopWorkers()
+	closeClients()
+	closeStreams()
+	stopWriter()
+	for _, socket := range sockets {
+		socket.Close()
+	}
+	ctx.stop()
+}
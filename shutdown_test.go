@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/epiphyte/radiucal/plugins"
+	"io"
+	"layeh.com/radius"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type stopModule struct {
+	MockModule
+	stopped bool
+}
+
+func (m *stopModule) Stop() {
+	m.stopped = true
+}
+
+func TestDrain(t *testing.T) {
+	closeClients()
+	drainTimeout = 200 * time.Millisecond
+	conn := newTestConnection(t, 10000)
+	conn.pending[pendingKey{identifier: 1}] = &request{sent: time.Now()}
+	conn.pending[pendingKey{identifier: 2}] = &request{sent: time.Now().Add(-time.Second)}
+	if inflight(time.Now().Add(-drainTimeout)) != 1 {
+		t.Error("should only count recent requests")
+	}
+	start := time.Now()
+	if drain() {
+		t.Error("request is still in flight")
+	}
+	if time.Since(start) < drainTimeout {
+		t.Error("should have waited for the drain timeout")
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.lock.Lock()
+		delete(conn.pending, pendingKey{identifier: 1})
+		conn.lock.Unlock()
+	}()
+	if !drain() {
+		t.Error("should have drained")
+	}
+	closeClients()
+	drainTimeout = 5 * time.Second
+}
+
+func TestShutdown(t *testing.T) {
+	closeClients()
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	conn := newTestConnection(t, 10000)
+	conn.pending[pendingKey{identifier: 1}] = &request{sent: time.Now()}
+	srv, cli := newUDPPair(t)
+	defer cli.Close()
+	reading := make(chan bool)
+	go func() {
+		readPackets(srv, func(b *[radius.MaxPacketLength]byte, n int, addr *net.UDPAddr) {
+			putBuffer(b)
+		})
+		close(reading)
+	}()
+	// the reply of a request in flight is sent while draining
+	replied := make(chan error, 1)
+	go func() {
+		<-reading
+		replied <- udpSender(srv, cli.LocalAddr().(*net.UDPAddr))([]byte("reply"))
+		conn.lock.Lock()
+		delete(conn.pending, pendingKey{identifier: 1})
+		conn.lock.Unlock()
+	}()
+	m := &stopModule{}
+	ctx := &context{}
+	ctx.modules = []plugins.Module{m, &MockModule{}}
+	shutdown(ctx, []io.Closer{listener}, []*net.UDPConn{srv})
+	if _, err := listener.Accept(); err == nil {
+		t.Error("listener should be closed")
+	}
+	if err := <-replied; err != nil {
+		t.Error("should reply while draining", err)
+	}
+	if _, err := srv.WriteToUDP([]byte("late"), cli.LocalAddr().(*net.UDPAddr)); err == nil {
+		t.Error("socket should be closed after draining")
+	}
+	atomic.StoreInt32(&readStopped, 0)
+	if !conn.closed() || len(clients) != 0 {
+		t.Error("should have closed clients")
+	}
+	if !m.stopped {
+		t.Error("should have stopped module")
+	}
+}
+
+func TestShutdownStreams(t *testing.T) {
+	closeClients()
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	nas := &client{secret: []byte("secret")}
+	go acceptStreams(listener, func(c net.Conn) {
+		serveStream(c, nas)
+	})
+	cli, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("unable to connect", err)
+	}
+	defer cli.Close()
+	var stream net.Conn
+	for stream == nil {
+		streamLock.Lock()
+		for s := range streams {
+			stream = s
+		}
+		streamLock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn := newTestConnection(t, 10000)
+	conn.pending[pendingKey{identifier: 1}] = &request{sent: time.Now()}
+	// the reply of a request in flight is sent on the stream while draining
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		stream.Write([]byte("reply"))
+		conn.lock.Lock()
+		delete(conn.pending, pendingKey{identifier: 1})
+		conn.lock.Unlock()
+	}()
+	shutdown(&context{}, []io.Closer{listener}, nil)
+	atomic.StoreInt32(&readStopped, 0)
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	var buffer [16]byte
+	n, err := io.ReadFull(cli, buffer[0:5])
+	if err != nil || string(buffer[0:n]) != "reply" {
+		t.Error("should reply while draining", err)
+	}
+	if _, err := cli.Read(buffer[0:]); err != io.EOF {
+		t.Error("stream should be closed after draining", err)
+	}
+	streamLock.Lock()
+	if len(streams) != 0 {
+		t.Error("should not track closed streams")
+	}
+	streamLock.Unlock()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"io"
+	"io/ioutil"
+	"layeh.com/radius"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// limit of concurrent stream (tcp/radsec) clients
+	streamLimit chan bool = make(chan bool, 100)
+	// accepted stream clients, closed on shutdown (after draining)
+	streams    map[net.Conn]bool = make(map[net.Conn]bool)
+	streamLock *sync.Mutex       = new(sync.Mutex)
+)
+
+// a listener was closed (net.ErrClosed is not available to check)
+func isClosed(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// read a single (length framed) packet from a stream
+func readPacket(r io.Reader, buffer []byte) (int, error) {
+	if _, err := io.ReadFull(r, buffer[0:4]); err != nil {
+		return 0, err
+	}
+	length := int(binary.BigEndian.Uint16(buffer[2:4]))
+	if length < 20 || length > radius.MaxPacketLength || length > len(buffer) {
+		return 0, errors.New("invalid packet length")
+	}
+	if _, err := io.ReadFull(r, buffer[4:length]); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// serve requests from a stream client until it closes (or idles)
+func serveStream(stream net.Conn, nas *client) {
+	cliaddr := stream.RemoteAddr()
+	defer dropConnection(cliaddr)
+	defer stream.Close()
+	lock := new(sync.Mutex)
+	send := func(b []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+		_, err := stream.Write(b)
+		return err
+	}
+	var buffer [radius.MaxPacketLength]byte
+	for {
+		stream.SetReadDeadline(time.Now().Add(idleTimeout))
+		if atomic.LoadInt32(&readStopped) == 1 {
+			awaitClose(stream)
+			return
+		}
+		n, err := readPacket(stream, buffer[0:])
+		if err != nil {
+			if readingStopped(err) {
+				awaitClose(stream)
+				return
+			}
+			if err != io.EOF {
+				goutils.WriteDebug("closing stream", cliaddr.String(), err.Error())
+			}
+			return
+		}
+		packet := buffer[0:n]
+		ctx := currentContext()
+		switch radius.Code(packet[0]) {
+		case radius.CodeAccessRequest:
+			authenticate(ctx, packet, cliaddr, nas, send)
+		case radius.CodeAccountingRequest:
+			accountRequest(ctx, packet, cliaddr, nas, send)
+		case radius.CodeStatusServer:
+			resp, err := ctx.status(packet, nas)
+			if logError("unable to create status response", err) {
+				continue
+			}
+			logError("status response", send(resp))
+		default:
+			goutils.WriteDebug("dropping unsupported packet", cliaddr.String())
+		}
+	}
+}
+
+// on shutdown no more requests are read, replies are sent until the stream is closed (after draining)
+func awaitClose(stream net.Conn) {
+	stream.SetReadDeadline(time.Time{})
+	io.Copy(ioutil.Discard, stream)
+}
+
+func trackStream(stream net.Conn) {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	streams[stream] = true
+}
+
+func untrackStream(stream net.Conn) {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	delete(streams, stream)
+}
+
+// stop reading requests from the stream clients (readStopped must be set)
+func stopStreams() {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	for stream := range streams {
+		stream.SetReadDeadline(time.Now())
+	}
+}
+
+func closeStreams() {
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	for stream := range streams {
+		stream.Close()
+	}
+	streams = make(map[net.Conn]bool)
+}
+
+// accept stream clients, clients beyond the stream limit are closed
+func acceptStreams(listener net.Listener, serve func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			logError("stream accept", err)
+			continue
+		}
+		limit := streamLimit
+		select {
+		case limit <- true:
+		default:
+			goutils.WriteInfo("stream limit reached, closing", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		go func(c net.Conn) {
+			defer func() { <-limit }()
+			trackStream(c)
+			defer untrackStream(c)
+			serve(c)
+		}(conn)
+	}
+}
+
+func listenTCP(port int) (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf(":%d", port))
+}
+
+// accept rfc6613 clients, each must be a known client (by address)
+func runTCP(listener net.Listener) {
+	acceptStreams(listener, func(conn net.Conn) {
+		addr := conn.RemoteAddr().(*net.TCPAddr)
+		nas := currentContext().clients.lookup(addr.IP)
+		if nas == nil {
+			goutils.WriteInfo("unknown tcp client", addr.String())
+			conn.Close()
+			return
+		}
+		serveStream(conn, nas)
+	})
+}
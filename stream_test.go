@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadPacket(t *testing.T) {
+	_, b := getPacket(t)
+	stream := bytes.NewBuffer(nil)
+	stream.Write(b)
+	stream.Write(b)
+	var buffer [radius.MaxPacketLength]byte
+	for i := 0; i < 2; i++ {
+		n, err := readPacket(stream, buffer[0:])
+		if err != nil || !bytes.Equal(buffer[0:n], b) {
+			t.Error("unable to read framed packet")
+		}
+	}
+	if _, err := readPacket(stream, buffer[0:]); err == nil {
+		t.Error("stream is empty")
+	}
+	stream.Write([]byte{1, 1, 0, 4})
+	if _, err := readPacket(stream, buffer[0:]); err == nil || err.Error() != "invalid packet length" {
+		t.Error("invalid length")
+	}
+	stream.Write(b[0 : len(b)-1])
+	if _, err := readPacket(stream, buffer[0:]); err == nil {
+		t.Error("truncated packet")
+	}
+}
+
+func statusRequest(secret []byte) []byte {
+	p := radius.New(radius.CodeStatusServer, secret)
+	rfc2869.MessageAuthenticator_Set(p, make([]byte, authenticatorLength))
+	b, _ := p.Encode()
+	signPacket(b, secret, nil)
+	return b
+}
+
+func TestTCP(t *testing.T) {
+	listener, err := listenTCP(0)
+	if err != nil {
+		t.Error("unable to listen")
+		return
+	}
+	defer listener.Close()
+	setContext(&context{})
+	go runTCP(listener)
+	b := statusRequest(nasSecret)
+	var buffer [radius.MaxPacketLength]byte
+	addr := fmt.Sprintf("127.0.0.1:%d", listener.Addr().(*net.TCPAddr).Port)
+	unknown, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error("unable to connect", err)
+		return
+	}
+	unknown.Write(b)
+	unknown.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := readPacket(unknown, buffer[0:]); err == nil {
+		t.Error("should not serve unknown clients")
+	}
+	unknown.Close()
+
+	network, _ := parseNetwork("127.0.0.1")
+	setContext(&context{clients: &clientTable{entries: []*client{&client{network: network, secret: nasSecret}}}})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error("unable to connect", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write(b)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := readPacket(conn, buffer[0:])
+	if err != nil {
+		t.Error("no status response", err)
+		return
+	}
+	if radius.Code(buffer[0]) != radius.CodeAccessAccept || !validResponse(buffer[0:n], b[4:20], nasSecret) {
+		t.Error("invalid status response")
+	}
+}
+
+func TestStreamLimit(t *testing.T) {
+	old := streamLimit
+	defer func() { streamLimit = old }()
+	streamLimit = make(chan bool, 1)
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	release := make(chan bool)
+	go acceptStreams(listener, func(conn net.Conn) {
+		<-release
+		conn.Close()
+	})
+	first, _ := net.Dial("tcp", listener.Addr().String())
+	defer first.Close()
+	time.Sleep(100 * time.Millisecond)
+	second, _ := net.Dial("tcp", listener.Addr().String())
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	var buffer [1]byte
+	if _, err := second.Read(buffer[0:]); err != io.EOF {
+		t.Error("should have closed stream over the limit", err)
+	}
+	close(release)
+}
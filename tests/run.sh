@@ -5,7 +5,7 @@ sleep 1
 bin/harness --endpoint=true &
 sleep 1
 bin/harness
-kill -2 $(pidof radiucal)
+kill -1 $(pidof radiucal)
 bin/harness
 sleep 1
 pkill radiucal
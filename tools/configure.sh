@@ -34,7 +34,7 @@ fi
 _sig() {
     echo "signal applications"
     kill -HUP $(pidof hostapd)
-    kill -2 $(pidof radiucal)
+    kill -HUP $(pidof radiucal)
 }
 
 cat users/user_* | sha256sum | cut -d " " -f 1 > $HASH 
@@ -96,9 +96,17 @@ _update_files() {
             rm -f $e
         fi
     done
-    for u in $(cat $manifest); do
-        touch ${p}$u
-    done
+    # entries are "<user>.<mac> <vlan>", the vlan is assigned by the usermac plugin
+    while read -r u vlan; do
+        if [ -z "$u" ]; then
+            continue
+        fi
+        if [ -n "$vlan" ]; then
+            echo "vlan=$vlan" > ${p}$u
+        else
+            touch ${p}$u
+        fi
+    done < $manifest
 }
 
 if [ $diffed -ne 0 ]; then
@@ -202,12 +202,12 @@ def _process(output):
             up = u[0].upper()
             f.write('"{}" MD5 "{}"\n'.format(up, up))
             write_vlan(f, u[1])
-            manifest.append((u[0], u[0]))
-    for u in store.get_tag(store.umac):
-        manifest.append((u[0], u[1]))
+            manifest.append((u[0], u[0], u[1]))
+    for u in store.get_user_macs():
+        manifest.append(u)
     with open(output + "manifest", 'w') as f:
         for m in sorted(manifest):
-            f.write("{}.{}\n".format(m[0], m[1]).lower())
+            f.write("{}.{} {}\n".format(m[0], m[1], m[2]).lower())
 
 
 def write_vlan(f, vlan_id):
@@ -286,6 +286,12 @@ class Store(object):
             vlan = u[0].split(".")[0]
             yield [u[0], u[1], self._get_vlan(vlan)]
 
+    def get_user_macs(self):
+        """Get user+mac entries with their vlan."""
+        for u in self.get_tag(self.umac):
+            vlan = u[0].split(".")[0]
+            yield (u[0], u[1], self._get_vlan(vlan))
+
     def _get_vlan(self, name):
         """Get vlans."""
         return self._vlans[name]
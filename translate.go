@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+)
+
+const (
+	microsoftVendor = 311
+	mppeSendKey     = 16
+	mppeRecvKey     = 17
+	saltLength      = 2
+)
+
+// re-encrypt an rfc2865 (5.2) style hidden value in place from one secret to another,
+// the first block is keyed on the seed (the request authenticator + salt if salted)
+func recrypt(value, seed, from, to []byte) {
+	if len(value) == 0 || len(value)%md5.Size != 0 {
+		return
+	}
+	plain := make([]byte, len(value))
+	prev := seed
+	for i := 0; i < len(value); i += md5.Size {
+		hash := md5.New()
+		hash.Write(from)
+		hash.Write(prev)
+		key := hash.Sum(nil)
+		for j := 0; j < md5.Size; j++ {
+			plain[i+j] = value[i+j] ^ key[j]
+		}
+		prev = value[i : i+md5.Size]
+	}
+	prev = seed
+	for i := 0; i < len(value); i += md5.Size {
+		hash := md5.New()
+		hash.Write(to)
+		hash.Write(prev)
+		key := hash.Sum(nil)
+		for j := 0; j < md5.Size; j++ {
+			value[i+j] = plain[i+j] ^ key[j]
+		}
+		prev = value[i : i+md5.Size]
+	}
+}
+
+// re-encrypt a salted (rfc2868/rfc2548) value: salt followed by the hidden value
+func recryptSalted(value, requestAuth, from, to []byte) {
+	if len(value) <= saltLength {
+		return
+	}
+	seed := append(append([]byte{}, requestAuth...), value[:saltLength]...)
+	recrypt(value[saltLength:], seed, from, to)
+}
+
+// re-encrypt the hidden attributes and sign an encoded packet with a different secret (in place)
+// requestAuth is the authenticator of the request (the packet's own authenticator for requests)
+func translate(b, requestAuth, from, to []byte) {
+	if bytes.Equal(from, to) || len(b) < 20 {
+		return
+	}
+	walkAttributes(b, func(t radius.Type, value []byte) bool {
+		switch t {
+		case rfc2865.UserPassword_Type:
+			recrypt(value, requestAuth, from, to)
+		case rfc2868.TunnelPassword_Type:
+			// tag then salt
+			if len(value) > 0 {
+				recryptSalted(value[1:], requestAuth, from, to)
+			}
+		case rfc2865.VendorSpecific_Type:
+			if len(value) < 4 || binary.BigEndian.Uint32(value[0:4]) != microsoftVendor {
+				break
+			}
+			vsa := value[4:]
+			for len(vsa) >= 2 {
+				size := int(vsa[1])
+				if size < 2 || size > len(vsa) {
+					break
+				}
+				if vsa[0] == mppeSendKey || vsa[0] == mppeRecvKey {
+					recryptSalted(vsa[2:size], requestAuth, from, to)
+				}
+				vsa = vsa[size:]
+			}
+		}
+		return true
+	})
+	signPacket(b, to, requestAuth)
+}
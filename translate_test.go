@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"testing"
+)
+
+var (
+	nasSecret      = []byte("nassecret")
+	upstreamSecret = []byte("upstreamsecret")
+)
+
+func TestTranslateRequest(t *testing.T) {
+	p := radius.New(radius.CodeAccessRequest, nasSecret)
+	rfc2865.UserName_SetString(p, "user")
+	rfc2865.UserPassword_SetString(p, "a password longer than one block")
+	b, _ := p.Encode()
+	auth := append([]byte{}, b[4:20]...)
+	translate(b, auth, nasSecret, upstreamSecret)
+	if !bytes.Equal(b[4:20], auth) {
+		t.Error("access-request authenticator should not change")
+	}
+	translated, err := radius.Parse(b, upstreamSecret)
+	if err != nil {
+		t.Error("unable to parse")
+	}
+	if rfc2865.UserPassword_GetString(translated) != "a password longer than one block" {
+		t.Error("password not re-encrypted")
+	}
+	if rfc2865.UserName_GetString(translated) != "user" {
+		t.Error("user name changed")
+	}
+}
+
+func TestTranslateAccounting(t *testing.T) {
+	p := radius.New(radius.CodeAccountingRequest, nasSecret)
+	rfc2865.UserName_SetString(p, "user")
+	b, _ := p.Encode()
+	translate(b, b[4:20], nasSecret, upstreamSecret)
+	expect := radius.New(radius.CodeAccountingRequest, upstreamSecret)
+	expect.Identifier = p.Identifier
+	rfc2865.UserName_SetString(expect, "user")
+	e, _ := expect.Encode()
+	if !bytes.Equal(b, e) {
+		t.Error("accounting request not signed with upstream secret")
+	}
+}
+
+func TestTranslateReply(t *testing.T) {
+	req := radius.New(radius.CodeAccessRequest, upstreamSecret)
+	p := req.Response(radius.CodeAccessAccept)
+	tunnel, _ := radius.NewTunnelPassword([]byte("tunnel"), []byte{0x80, 0x01}, upstreamSecret, req.Authenticator[:])
+	p.Add(rfc2868.TunnelPassword_Type, append([]byte{0x00}, tunnel...))
+	key, _ := radius.NewTunnelPassword([]byte("mppe key"), []byte{0x80, 0x02}, upstreamSecret, req.Authenticator[:])
+	vsa := make([]byte, 4)
+	binary.BigEndian.PutUint32(vsa, microsoftVendor)
+	vsa = append(vsa, mppeRecvKey, byte(len(key)+2))
+	vsa = append(vsa, key...)
+	p.Add(rfc2865.VendorSpecific_Type, vsa)
+	b, _ := p.Encode()
+	if !validResponse(b, req.Authenticator[:], upstreamSecret) {
+		t.Error("invalid upstream reply")
+	}
+	translate(b, req.Authenticator[:], upstreamSecret, nasSecret)
+	if !validResponse(b, req.Authenticator[:], nasSecret) {
+		t.Error("reply not signed with the nas secret")
+	}
+	translated, _ := radius.Parse(b, nasSecret)
+	pass, _, err := radius.TunnelPassword(translated.Get(rfc2868.TunnelPassword_Type)[1:], nasSecret, req.Authenticator[:])
+	if err != nil || string(pass) != "tunnel" {
+		t.Error("tunnel password not re-encrypted")
+	}
+	vendor := translated.Get(rfc2865.VendorSpecific_Type)
+	pass, _, err = radius.TunnelPassword(vendor[6:], nasSecret, req.Authenticator[:])
+	if err != nil || string(pass) != "mppe key" {
+		t.Error("mppe key not re-encrypted")
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPool    = "default"
+	accountingPool = "accounting"
+	tcpScheme      = "tcp://"
+)
+
+var (
+	pools          map[string]*pool = make(map[string]*pool)
+	upstreamLock   *sync.RWMutex    = new(sync.RWMutex)
+	pinned         map[string]*pin  = make(map[string]*pin)
+	pinLock        *sync.Mutex      = new(sync.Mutex)
+	pinTimeout     time.Duration    = time.Minute
+	healthInterval time.Duration
+	healthTimeout  time.Duration = 5 * time.Second
+	healthFailures int           = 3
+)
+
+type upstream struct {
+	addr   *net.UDPAddr
+	name   string
+	secret []byte
+	// rfc6613 transport
+	tcp bool
+	// guarded by upstreamLock
+	alive    bool
+	failures int
+}
+
+// upstreams in order of preference
+type pool struct {
+	name    string
+	servers []*upstream
+}
+
+// EAP conversation (State) pinned to the upstream that issued it
+type pin struct {
+	server *upstream
+	last   time.Time
+}
+
+// create an upstream from host:port (tcp://host:port for rfc6613)
+func newUpstream(hostport string, secret []byte) (*upstream, error) {
+	tcp := strings.HasPrefix(hostport, tcpScheme)
+	addr, err := net.ResolveUDPAddr("udp", strings.TrimPrefix(hostport, tcpScheme))
+	if err != nil {
+		return nil, err
+	}
+	return &upstream{addr: addr, name: hostport, secret: secret, alive: true, tcp: tcp}, nil
+}
+
+func (u *upstream) isAlive() bool {
+	upstreamLock.RLock()
+	defer upstreamLock.RUnlock()
+	return u.alive
+}
+
+func (u *upstream) is(addr *net.UDPAddr) bool {
+	return u.addr.IP.Equal(addr.IP) && u.addr.Port == addr.Port
+}
+
+// create a pool, each upstream will use its secret from the table (if given) or the default secret (if any)
+func newPool(name string, hostports []string, secrets *clientTable, secret []byte) (*pool, error) {
+	servers := &pool{name: name}
+	for _, h := range hostports {
+		u, err := newUpstream(h, secret)
+		if err != nil {
+			return nil, err
+		}
+		if c := secrets.lookup(u.addr.IP); c != nil {
+			u.secret = c.secret
+		}
+		if len(u.secret) == 0 {
+			return nil, errors.New(fmt.Sprintf("no secret for upstream: %s", h))
+		}
+		servers.servers = append(servers.servers, u)
+	}
+	if len(servers.servers) == 0 {
+		return nil, errors.New(fmt.Sprintf("no upstream servers: %s", name))
+	}
+	return servers, nil
+}
+
+// replace all pools, upstreams that did not change are kept (with their health)
+func setPools(next map[string]*pool) {
+	upstreamLock.Lock()
+	defer upstreamLock.Unlock()
+	for name, p := range next {
+		old, ok := pools[name]
+		if !ok {
+			continue
+		}
+		for i, u := range p.servers {
+			for _, o := range old.servers {
+				if o.name == u.name && bytes.Equal(o.secret, u.secret) {
+					p.servers[i] = o
+				}
+			}
+		}
+	}
+	pools = next
+}
+
+// describe how the pools differ from the current pools
+func poolChanges(next map[string]*pool) []string {
+	upstreamLock.RLock()
+	defer upstreamLock.RUnlock()
+	var changed []string
+	for name, p := range next {
+		cur := p.String()
+		old := ""
+		if o, ok := pools[name]; ok {
+			old = o.String()
+		}
+		if cur != old {
+			changed = append(changed, fmt.Sprintf("upstream %s: [%s] -> [%s]", name, old, cur))
+		}
+	}
+	for name, o := range pools {
+		if _, ok := next[name]; !ok {
+			changed = append(changed, fmt.Sprintf("upstream %s: [%s] -> []", name, o.String()))
+		}
+	}
+	return changed
+}
+
+func (p *pool) String() string {
+	var names []string
+	for _, u := range p.servers {
+		names = append(names, u.name)
+	}
+	return strings.Join(names, " ")
+}
+
+func (p *pool) has(server *upstream) bool {
+	for _, u := range p.servers {
+		if u == server {
+			return true
+		}
+	}
+	return false
+}
+
+// get a pool by name, nil if not configured
+func getPool(name string) *pool {
+	upstreamLock.RLock()
+	defer upstreamLock.RUnlock()
+	return pools[name]
+}
+
+// all upstreams (of all pools)
+func allUpstreams() []*upstream {
+	upstreamLock.RLock()
+	defer upstreamLock.RUnlock()
+	var servers []*upstream
+	for _, p := range pools {
+		servers = append(servers, p.servers...)
+	}
+	return servers
+}
+
+// first healthy upstream in configured order (or the first upstream if none are healthy)
+func (p *pool) healthy() *upstream {
+	upstreamLock.RLock()
+	defer upstreamLock.RUnlock()
+	for _, u := range p.servers {
+		if u.alive {
+			return u
+		}
+	}
+	return p.servers[0]
+}
+
+// select the upstream for a request, an EAP conversation stays with the upstream that issued the State
+func selectUpstream(servers *pool, p *radius.Packet) *upstream {
+	if p != nil {
+		if state, err := rfc2865.State_Lookup(p); err == nil {
+			pinLock.Lock()
+			pinning, ok := pinned[string(state)]
+			if ok {
+				pinning.last = time.Now()
+			}
+			pinLock.Unlock()
+			if ok && servers.has(pinning.server) && pinning.server.isAlive() {
+				return pinning.server
+			}
+		}
+	}
+	return servers.healthy()
+}
+
+// track the State issued by an upstream so the conversation continues there
+func pinState(p *radius.Packet, server *upstream) {
+	if p.Code != radius.CodeAccessChallenge {
+		return
+	}
+	state, err := rfc2865.State_Lookup(p)
+	if err != nil {
+		return
+	}
+	pinLock.Lock()
+	defer pinLock.Unlock()
+	pinned[string(state)] = &pin{server: server, last: time.Now()}
+}
+
+func evictStates(now time.Time) {
+	pinLock.Lock()
+	defer pinLock.Unlock()
+	for k, p := range pinned {
+		if now.Sub(p.last) >= pinTimeout {
+			delete(pinned, k)
+		}
+	}
+}
+
+// mark an upstream with the result of a health check
+func markUpstream(u *upstream, healthy bool) {
+	upstreamLock.Lock()
+	defer upstreamLock.Unlock()
+	if healthy {
+		if !u.alive {
+			goutils.WriteInfo("upstream is alive", u.name)
+		}
+		u.alive = true
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if u.alive && u.failures >= healthFailures {
+		goutils.WriteInfo("upstream is dead", u.name)
+		u.alive = false
+	}
+}
+
+// send a Status-Server (rfc5997) and wait for any authentic reply
+func probe(u *upstream) error {
+	secret := u.secret
+	p := radius.New(radius.CodeStatusServer, secret)
+	if err := rfc2869.MessageAuthenticator_Set(p, make([]byte, authenticatorLength)); err != nil {
+		return err
+	}
+	req, err := p.Encode()
+	if err != nil {
+		return err
+	}
+	signPacket(req, secret, nil)
+	network := "udp"
+	if u.tcp {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, u.addr.String(), healthTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(healthTimeout))
+	var buffer [radius.MaxPacketLength]byte
+	for {
+		var n int
+		var err error
+		if u.tcp {
+			n, err = readPacket(conn, buffer[0:])
+		} else {
+			n, err = conn.Read(buffer[0:])
+		}
+		if err != nil {
+			return err
+		}
+		resp := buffer[0:n]
+		if validResponse(resp, req[4:20], secret) && resp[1] == req[1] {
+			return nil
+		}
+	}
+}
+
+func checkUpstreams() {
+	for range time.Tick(healthInterval) {
+		for _, u := range allUpstreams() {
+			go func(u *upstream) {
+				err := probe(u)
+				if err != nil {
+					goutils.WriteDebug(fmt.Sprintf("status-server failed: %s (%s)", u.name, err))
+				}
+				markUpstream(u, err == nil)
+			}(u)
+		}
+	}
+}
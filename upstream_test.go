@@ -0,0 +1,118 @@
+package main
+
+import (
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamFailover(t *testing.T) {
+	servers, err := newPool(defaultPool, []string{"127.0.0.1:1814", "127.0.0.1:1815"}, nil, []byte("secret"))
+	if err != nil {
+		t.Error("unable to setup upstreams")
+	}
+	setPools(map[string]*pool{defaultPool: servers})
+	first := servers.servers[0]
+	second := servers.servers[1]
+	if selectUpstream(servers, nil) != first {
+		t.Error("should prefer the first upstream")
+	}
+	healthFailures = 2
+	markUpstream(first, false)
+	if selectUpstream(servers, nil) != first {
+		t.Error("should still be alive")
+	}
+	markUpstream(first, false)
+	if selectUpstream(servers, nil) != second {
+		t.Error("should have failed over")
+	}
+	markUpstream(second, false)
+	markUpstream(second, false)
+	if selectUpstream(servers, nil) != first {
+		t.Error("should fallback to the first upstream")
+	}
+	markUpstream(first, true)
+	markUpstream(second, true)
+	if string(first.secret) != "secret" {
+		t.Error("should use the default secret")
+	}
+	if !second.is(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1815}) {
+		t.Error("should match upstream address")
+	}
+	if second.is(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}) {
+		t.Error("not the upstream")
+	}
+	if getPool(accountingPool) != nil {
+		t.Error("no accounting pool")
+	}
+}
+
+func TestUpstreamSecrets(t *testing.T) {
+	table, _ := parseClientFile("./tests/clients")
+	servers, err := newPool(defaultPool, []string{"127.0.0.1:1814", "10.10.10.10:1812"}, table, []byte("secret"))
+	if err != nil {
+		t.Error("unable to setup upstreams")
+	}
+	if string(servers.servers[0].secret) != "test" || string(servers.servers[1].secret) != "switch" {
+		t.Error("wrong upstream secrets")
+	}
+	if _, err := newPool(defaultPool, []string{"10.11.1.1:1812"}, table, nil); err == nil {
+		t.Error("upstream has no secret")
+	}
+	if servers, err := newPool(defaultPool, []string{"10.11.1.1:1812"}, table, []byte("secret")); err != nil || string(servers.servers[0].secret) != "secret" {
+		t.Error("should use the default secret", err)
+	}
+	if _, err := newPool(defaultPool, []string{}, table, []byte("secret")); err == nil {
+		t.Error("pool has no upstreams")
+	}
+}
+
+func TestUpstreamPinning(t *testing.T) {
+	servers, _ := newPool(defaultPool, []string{"127.0.0.1:1814", "127.0.0.1:1815"}, nil, []byte("secret"))
+	second := servers.servers[1]
+	ctx, b := getPacket(t)
+	req, _ := ctx.packet(b, localNAS(ctx))
+	challenge := req.Response(radius.CodeAccessChallenge)
+	rfc2865.State_Set(challenge, []byte("state"))
+	pinState(challenge, second)
+	rfc2865.State_Set(req, []byte("state"))
+	if selectUpstream(servers, req) != second {
+		t.Error("should be pinned")
+	}
+	evictStates(time.Now().Add(2 * pinTimeout))
+	if selectUpstream(servers, req) == second {
+		t.Error("should no longer be pinned")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	secret := []byte("secret")
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Error("unable to listen")
+	}
+	defer srv.Close()
+	go func() {
+		var buffer [radius.MaxPacketLength]byte
+		n, addr, err := srv.ReadFromUDP(buffer[0:])
+		if err != nil {
+			return
+		}
+		p, err := radius.Parse(buffer[0:n], secret)
+		if err != nil || p.Code != radius.CodeStatusServer {
+			return
+		}
+		b, _ := p.Response(radius.CodeAccessAccept).Encode()
+		srv.WriteToUDP(b, addr)
+	}()
+	u, _ := newUpstream(srv.LocalAddr().String(), secret)
+	healthTimeout = time.Second
+	if err := probe(u); err != nil {
+		t.Error("probe should have passed", err)
+	}
+	if err := probe(u); err == nil {
+		t.Error("probe should have timed out")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/epiphyte/goutils"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// worker queues, requests are handled inline when there are none
+	queues     []chan func()
+	queued     int64
+	overloaded int64
+	queueLock  *sync.Mutex = new(sync.Mutex)
+	// jobs queued or running (inline or on a worker)
+	running *sync.WaitGroup = new(sync.WaitGroup)
+)
+
+// start the workers, each with a bounded queue
+func startWorkers(workers, depth int) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	for i := 0; i < workers; i++ {
+		queue := make(chan func(), depth)
+		queues = append(queues, queue)
+		go work(queue)
+	}
+}
+
+func work(queue chan func()) {
+	for job := range queue {
+		job()
+		atomic.AddInt64(&queued, -1)
+		running.Done()
+	}
+}
+
+// queue a job, jobs from the same source go to the same worker (in order)
+// false if the worker queue is full and the job was dropped
+func dispatch(source string, job func()) bool {
+	queueLock.Lock()
+	if len(queues) == 0 {
+		queueLock.Unlock()
+		running.Add(1)
+		defer running.Done()
+		job()
+		return true
+	}
+	defer queueLock.Unlock()
+	hash := fnv.New32a()
+	hash.Write([]byte(source))
+	queue := queues[hash.Sum32()%uint32(len(queues))]
+	atomic.AddInt64(&queued, 1)
+	running.Add(1)
+	select {
+	case queue <- job:
+		return true
+	default:
+		atomic.AddInt64(&queued, -1)
+		atomic.AddInt64(&overloaded, 1)
+		running.Done()
+		return false
+	}
+}
+
+// stop the workers, waiting for the queued and running jobs
+func stopWorkers() {
+	queueLock.Lock()
+	for _, queue := range queues {
+		close(queue)
+	}
+	queues = nil
+	queueLock.Unlock()
+	running.Wait()
+}
+
+// report (and reset) requests dropped because of a full queue
+func reportOverload() {
+	for _ = range time.Tick(time.Minute) {
+		if dropped := atomic.SwapInt64(&overloaded, 0); dropped > 0 {
+			goutils.WriteInfo("overloaded, dropped requests", fmt.Sprintf("%d", dropped))
+		}
+	}
+}
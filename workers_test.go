@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatchInline(t *testing.T) {
+	ran := false
+	if !dispatch("source", func() { ran = true }) || !ran {
+		t.Error("should run inline without workers")
+	}
+}
+
+func TestDispatchOrder(t *testing.T) {
+	startWorkers(4, 100)
+	defer stopWorkers()
+	lock := new(sync.Mutex)
+	seen := make(map[string][]int)
+	done := new(sync.WaitGroup)
+	for i := 0; i < 50; i++ {
+		for _, source := range []string{"a", "b", "c"} {
+			done.Add(1)
+			s, n := source, i
+			if !dispatch(s, func() {
+				defer done.Done()
+				lock.Lock()
+				defer lock.Unlock()
+				seen[s] = append(seen[s], n)
+			}) {
+				t.Error("should have queued")
+			}
+		}
+	}
+	done.Wait()
+	for source, order := range seen {
+		for i, n := range order {
+			if i != n {
+				t.Error("out of order", source)
+				break
+			}
+		}
+	}
+}
+
+func TestDispatchOverload(t *testing.T) {
+	atomic.StoreInt64(&overloaded, 0)
+	startWorkers(1, 1)
+	block := make(chan bool)
+	started := make(chan bool)
+	dispatch("a", func() {
+		started <- true
+		<-block
+	})
+	<-started
+	if !dispatch("a", func() {}) {
+		t.Error("should have queued")
+	}
+	if dispatch("a", func() {}) {
+		t.Error("queue is full")
+	}
+	if atomic.LoadInt64(&overloaded) != 1 || atomic.LoadInt64(&queued) != 2 {
+		t.Error("invalid counters")
+	}
+	close(block)
+	stopWorkers()
+	if atomic.LoadInt64(&queued) != 0 {
+		t.Error("should have waited for the queued jobs")
+	}
+	atomic.StoreInt64(&overloaded, 0)
+}
+
+func TestStopWorkersWaits(t *testing.T) {
+	startWorkers(1, 1)
+	block := make(chan bool)
+	started := make(chan bool)
+	finished := false
+	dispatch("a", func() {
+		started <- true
+		<-block
+		finished = true
+	})
+	<-started
+	stopped := make(chan bool)
+	go func() {
+		stopWorkers()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Error("should wait for the running job")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(block)
+	<-stopped
+	if !finished {
+		t.Error("job should have finished")
+	}
+}